@@ -2,20 +2,20 @@ package cmd
 
 import (
 	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/lego"
-	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/spf13/cobra"
 )
@@ -23,150 +23,365 @@ import (
 var acmeCmd = &cobra.Command{
 	Use:   "acme",
 	Short: "ACME certificate management",
-	Long:  "Issue and renew Let's Encrypt certificates via Lego and Cloudflare DNS-01 challenge",
+	Long:  "Issue and renew ACME certificates via Lego and the DNS-01 challenge of any Lego DNS provider (Cloudflare by default)",
 }
 
 var issueCmd = &cobra.Command{
-	Use:   "issue",
-	Short: "Issue/renew certificate",
+	Use:   "issue [name...]",
+	Short: "Issue/renew certificates",
+	Long:  "Issue new certificates for all managed certificates or the named ones, regardless of their expiry",
 	Run: func(cmd *cobra.Command, args []string) {
-		config := getAcmeConfig()
+		config, certs := requireIssueConfig(args)
 
-		if config.CFToken == "" || config.Domain == "" || config.Email == "" {
-			fmt.Println("Error: CF_API_TOKEN, ACME_DOMAIN, and ACME_EMAIL environment variables are required")
-			os.Exit(1)
-		}
-
-		fmt.Printf("Issuing certificate for domain: %s\n", config.Domain)
+		results := renewCertificates(certs, true, config.Concurrency, nil, func(cert CertificateConfig) error {
+			return issueCertificate(config, cert)
+		})
 
-		if err := issueCertificate(config); err != nil {
-			fmt.Printf("Certificate issue failed: %v\n", err)
+		if printCertificateResults(os.Stdout, results) {
 			os.Exit(1)
 		}
-
-		fmt.Printf("Certificate for %s issued successfully.\n", config.Domain)
 	},
 }
 
 type AcmeConfig struct {
-	Domain   string
-	CertPath string
-	Email    string
-	CFToken  string
+	Domain         string
+	Domains        []string
+	CertName       string
+	CertPath       string
+	Email          string
+	CFToken        string
+	StateDir       string
+	CADirURL       string
+	CABundle       string
+	EABKeyID       string
+	EABHMAC        string
+	KeyType        certcrypto.KeyType
+	DualKeyType    certcrypto.KeyType
+	AccountKeyType certcrypto.KeyType
+	RenewDays      int
+	Challenge      string
+	DNSProvider    string
+	ChallengeAlias []string
+	DNSResolvers   []string
+
+	DNSPropagationTimeout time.Duration
+	DNSPollingInterval    time.Duration
+	DNSSkipPreCheck       bool
+	DNSPropagationWait    time.Duration
+
+	HTTPPort       string
+	HTTPWebroot    string
+	TLSPort        string
+	Deploy         []string
+	Outputs        []string
+	PKCS12Password string
+	PKCS12Encoding string
+	SynologyRoot   string
+	SynologyReload []string
+	PreDeploy      string
+	PostDeploy     string
+	HookTimeout    time.Duration
+	Backups        int
+	ARI            bool
+	Profile        string
+	ReuseKey       bool
+	KeyFile        string
+	CSR            string
+	Concurrency    int
+	TLSA           []string
+	TLSAUsage      []string
+	TLSADelay      time.Duration
+	TLSAWait       time.Duration
+	CAACheck       bool
+	VerifyTimeout  time.Duration
 }
 
 func getAcmeConfig() AcmeConfig {
+	domains := getEnvList("ACME_DOMAINS")
+	if len(domains) == 0 {
+		domains = getEnvList("ACME_DOMAIN")
+	}
+
+	domain := ""
+	if len(domains) > 0 {
+		domain = domains[0]
+	}
+
 	return AcmeConfig{
-		Domain:   getEnv("ACME_DOMAIN", ""),
-		CertPath: getEnv("ACME_CERT_PATH", "./cert"),
-		Email:    getEnv("ACME_EMAIL", ""),
-		CFToken:  getEnv("CF_API_TOKEN", ""),
+		Domain:         domain,
+		Domains:        domains,
+		CertName:       getEnv("ACME_CERT_NAME", certName(domain)),
+		CertPath:       getEnv("ACME_CERT_PATH", "./cert"),
+		Email:          getEnv("ACME_EMAIL", ""),
+		CFToken:        getEnv("CF_API_TOKEN", ""),
+		StateDir:       getEnv("ACME_STATE_DIR", filepath.Join(os.Getenv("HOME"), ".nas-manager", "acme")),
+		CADirURL:       caDirectoryURL(getEnv("ACME_DIRECTORY", "letsencrypt")),
+		CABundle:       getEnv("ACME_CA_BUNDLE", ""),
+		EABKeyID:       getEnv("ACME_EAB_KID", ""),
+		EABHMAC:        getEnv("ACME_EAB_HMAC", ""),
+		KeyType:        envKeyType("ACME_KEY_TYPE", certcrypto.EC256),
+		DualKeyType:    envKeyType("ACME_DUAL_KEY_TYPE", ""),
+		AccountKeyType: envKeyType("ACME_ACCOUNT_KEY_TYPE", certcrypto.EC256),
+		RenewDays:      getEnvInt("ACME_RENEW_DAYS", 30),
+		Challenge:      strings.ToLower(getEnv("ACME_CHALLENGE", challengeDNS01)),
+		DNSProvider:    getEnv("ACME_DNS_PROVIDER", "cloudflare"),
+		ChallengeAlias: getEnvList("ACME_CHALLENGE_ALIAS"),
+		DNSResolvers:   getEnvList("ACME_DNS_RESOLVERS"),
+
+		DNSPropagationTimeout: getEnvDuration("ACME_DNS_PROPAGATION_TIMEOUT", 0),
+		DNSPollingInterval:    getEnvDuration("ACME_DNS_POLLING_INTERVAL", 0),
+		DNSSkipPreCheck:       getEnvBool("ACME_DNS_SKIP_PRECHECK", false),
+		DNSPropagationWait:    getEnvDuration("ACME_DNS_PROPAGATION_WAIT", 0),
+
+		HTTPPort:       getEnv("ACME_HTTP_PORT", "80"),
+		HTTPWebroot:    getEnv("ACME_HTTP_WEBROOT", ""),
+		TLSPort:        getEnv("ACME_TLS_PORT", "443"),
+		Deploy:         getEnvList("ACME_DEPLOY"),
+		Outputs:        getEnvList("ACME_OUTPUTS"),
+		PKCS12Password: getEnv("ACME_PKCS12_PASSWORD", ""),
+		PKCS12Encoding: strings.ToLower(getEnv("ACME_PKCS12_ENCODING", "legacy")),
+		SynologyRoot:   getEnv("ACME_SYNOLOGY_ROOT", "/"),
+		SynologyReload: getEnvList("ACME_SYNOLOGY_RELOAD"),
+		PreDeploy:      getEnv("ACME_PRE_DEPLOY", ""),
+		PostDeploy:     getEnv("ACME_POST_DEPLOY", defaultPostDeploy()),
+		HookTimeout:    getEnvDuration("ACME_HOOK_TIMEOUT", 2*time.Minute),
+		Backups:        getEnvInt("ACME_BACKUPS", 5),
+		ARI:            getEnvBool("ACME_ARI", true),
+		Profile:        getEnv("ACME_PROFILE", ""),
+		ReuseKey:       getEnvBool("ACME_REUSE_KEY", false),
+		KeyFile:        getEnv("ACME_KEY_FILE", ""),
+		CSR:            getEnv("ACME_CSR", ""),
+		Concurrency:    getEnvInt("ACME_CONCURRENCY", 1),
+		TLSA:           getEnvList("ACME_TLSA"),
+		TLSAUsage:      getEnvList("ACME_TLSA_USAGE"),
+		TLSADelay:      getEnvDuration("ACME_TLSA_DELAY", 24*time.Hour),
+		TLSAWait:       getEnvDuration("ACME_TLSA_WAIT", 0),
+		CAACheck:       getEnvBool("ACME_CAA_CHECK", true),
+		VerifyTimeout:  getEnvDuration("ACME_VERIFY_TIMEOUT", time.Minute),
 	}
 }
 
-func issueCertificate(config AcmeConfig) error {
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return err
+// requireIssueConfig returns the ACME configuration and the selected certificates
+// or exits when required values are missing
+func requireIssueConfig(names []string) (AcmeConfig, []CertificateConfig) {
+	config, certs := requireCertificates(names)
+	if config.Email == "" {
+		fmt.Println("Error: ACME_EMAIL environment variable is required")
+		os.Exit(1)
 	}
 
-	user := &User{
-		Email: config.Email,
-		key:   privateKey,
+	// The Cloudflare provider reads its token from CLOUDFLARE_DNS_API_TOKEN,
+	// fall back to the token shared with DDNS
+	if config.CFToken != "" && os.Getenv("CLOUDFLARE_DNS_API_TOKEN") == "" && os.Getenv("CLOUDFLARE_DNS_API_TOKEN_FILE") == "" {
+		os.Setenv("CLOUDFLARE_DNS_API_TOKEN", config.CFToken)
 	}
+	return config, certs
+}
 
-	legoConfig := lego.NewConfig(user)
-	legoConfig.Certificate.KeyType = certcrypto.EC256
+// requireCertificates returns the ACME configuration and the selected certificates
+// or exits when the certificate inventory is missing or invalid
+func requireCertificates(names []string) (AcmeConfig, []CertificateConfig) {
+	config := getAcmeConfig()
+	if err := validateAcmeConfig(config); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 
-	client, err := lego.NewClient(legoConfig)
+	certs, err := getCertificates(config)
 	if err != nil {
-		return err
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(certs) == 0 {
+		fmt.Println("Error: ACME_DOMAIN (or ACME_DOMAINS or ACME_CERTIFICATES) environment variable is required")
+		os.Exit(1)
 	}
 
-	os.Setenv("CLOUDFLARE_DNS_API_TOKEN", config.CFToken)
-	provider, err := cloudflare.NewDNSProvider()
+	certs, err = selectCertificates(certs, names)
 	if err != nil {
-		return err
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
 	}
+	return config, certs
+}
 
-	client.Challenge.SetDNS01Provider(provider)
+// caDirectories are the named ACME directory presets accepted by ACME_DIRECTORY
+var caDirectories = map[string]string{
+	"letsencrypt":         lego.LEDirectoryProduction,
+	"letsencrypt-staging": lego.LEDirectoryStaging,
+	"zerossl":             "https://acme.zerossl.com/v2/DV90",
+	"google":              "https://dv.acme-v02.api.pki.goog/directory",
+	"google-staging":      "https://dv.acme-v02.test-api.pki.goog/directory",
+}
 
-	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
-	if err != nil {
-		return err
+// caDirectoryURL resolves a directory preset name. Other values are returned unchanged.
+func caDirectoryURL(value string) string {
+	if dirURL, ok := caDirectories[strings.ToLower(value)]; ok {
+		return dirURL
 	}
-	user.Registration = reg
+	return value
+}
 
-	request := certificate.ObtainRequest{
-		Domains: []string{config.Domain},
-		Bundle:  true,
+// validateAcmeConfig checks the CA related settings
+func validateAcmeConfig(config AcmeConfig) error {
+	u, err := url.Parse(config.CADirURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("ACME_DIRECTORY must be a directory URL or one of letsencrypt, letsencrypt-staging, zerossl, google, google-staging (got %q)", config.CADirURL)
+	}
+	if (config.EABKeyID == "") != (config.EABHMAC == "") {
+		return errors.New("ACME_EAB_KID and ACME_EAB_HMAC must be set together")
+	}
+	if config.CABundle != "" {
+		if _, err := os.Stat(config.CABundle); err != nil {
+			return fmt.Errorf("ACME_CA_BUNDLE: %v", err)
+		}
 	}
+	return nil
+}
+
+// certName returns the file name used for the certificate of domain.
+// Wildcards are replaced so "*.example.com" is stored as "_.example.com".
+func certName(domain string) string {
+	return strings.ReplaceAll(domain, "*", "_")
+}
 
-	certs, err := client.Certificate.Obtain(request)
+func issueCertificate(config AcmeConfig, cert CertificateConfig) error {
+	user, err := getAccount(config)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to get ACME account: %v", err)
 	}
 
-	certPath := config.CertPath
-	usingFallback := false
+	if config.CAACheck {
+		if err := checkCertificateCAA(config, user, cert); err != nil {
+			return err
+		}
+	}
 
-	// Try to create directory and test write permissions
-	if err := os.MkdirAll(certPath, 0755); err != nil {
-		usingFallback = true
-	} else {
-		// Test write permissions by creating a temporary file
-		testFile := filepath.Join(certPath, ".write_test")
-		if err := os.WriteFile(testFile, []byte("test"), 0644); err != nil {
-			usingFallback = true
-		} else {
-			os.Remove(testFile)
+	// Obtain all key type variants before touching the installed files
+	files := map[string][]byte{}
+	for _, variant := range cert.variants() {
+		certs, err := obtainCertificate(config, user, cert, variant)
+		if err != nil {
+			return fmt.Errorf("%s certificate: %v", keyTypeName(variant.KeyType), err)
+		}
+		variantFiles, err := certificateFiles(cert, certs)
+		if err != nil {
+			return fmt.Errorf("%s certificate: %v", keyTypeName(variant.KeyType), err)
+		}
+		for filename, content := range variantFiles {
+			files[variantFileName(filename, variant.Suffix)] = content
 		}
 	}
 
-	if usingFallback {
-		dateStr := time.Now().Format("2006-01-02")
-		domainSafe := strings.ReplaceAll(config.Domain, ".", "_")
-		certPath = fmt.Sprintf("./certs/%s-%s", domainSafe, dateStr)
-		fmt.Printf("Permission denied for %s, using fallback directory: %s\n", config.CertPath, certPath)
-		if err := os.MkdirAll(certPath, 0755); err != nil {
-			return fmt.Errorf("failed to create fallback directory: %v", err)
+	return deployCertificate(cert, files)
+}
+
+// obtainCertificate requests the certificate variant for the domains of cert,
+// or for the configured CSR
+func obtainCertificate(config AcmeConfig, user *User, cert CertificateConfig, variant certificateVariant) (*certificate.Resource, error) {
+	legoConfig, err := newLegoConfig(config, user)
+	if err != nil {
+		return nil, err
+	}
+	legoConfig.Certificate.KeyType = variant.KeyType
+
+	client, err := lego.NewClient(legoConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setChallengeProvider(client, cert); err != nil {
+		return nil, err
+	}
+
+	// Built-in challenge listeners bind a fixed port, so only one issuance can use them at a time
+	if cert.usesListener() {
+		listenerMu.Lock()
+		defer listenerMu.Unlock()
+	}
+
+	if cert.Profile != "" {
+		if err := checkProfile(legoConfig.HTTPClient, config.CADirURL, cert.Profile); err != nil {
+			return nil, err
 		}
 	}
 
-	// Write certificates
-	files := map[string][]byte{
-		config.Domain + ".key": certs.PrivateKey,
-		config.Domain + ".cer": certs.Certificate,
-		"fullchain.cer":        certs.Certificate,
-		"ca.cer":               certs.IssuerCertificate,
-		"privkey.pem":          certs.PrivateKey,
-		"fullchain.pem":        certs.Certificate,
+	key, err := certificateKey(cert, variant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %v", err)
+	}
+
+	// The CA may exempt replacements of the installed certificate from rate limits
+	replaces := ""
+	if cert.ReplaceInstalled {
+		replaces = installedCertID(cert, variant)
 	}
 
-	for filename, content := range files {
-		perm := os.FileMode(0644)
-		if filepath.Ext(filename) == ".key" || filename == "privkey.pem" {
-			perm = 0600
+	var csr *x509.CertificateRequest
+	if cert.CSR != "" {
+		if csr, err = readCSR(cert.CSR); err != nil {
+			return nil, err
 		}
-		if err := os.WriteFile(filepath.Join(certPath, filename), content, perm); err != nil {
-			return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+
+	obtain := func(replaces string) (*certificate.Resource, error) {
+		if csr != nil {
+			certs, err := client.Certificate.ObtainForCSR(certificate.ObtainForCSRRequest{
+				CSR:            csr,
+				PrivateKey:     key,
+				Bundle:         true,
+				Profile:        cert.Profile,
+				ReplacesCertID: replaces,
+			})
+			if err == nil && key != nil && len(certs.PrivateKey) == 0 {
+				certs.PrivateKey = certcrypto.PEMEncode(key)
+			}
+			return certs, err
 		}
+
+		return client.Certificate.Obtain(certificate.ObtainRequest{
+			Domains:        cert.Domains,
+			PrivateKey:     key,
+			Bundle:         true,
+			Profile:        cert.Profile,
+			ReplacesCertID: replaces,
+		})
+	}
+
+	certs, err := obtain(replaces)
+	// The CA may refuse the replacement, e.g. of a certificate issued to another account
+	if err != nil && replaces != "" {
+		fmt.Printf("[%s] Order replacing the installed certificate failed, retrying without: %v\n", cert.Name, err)
+		certs, err = obtain("")
 	}
+	return certs, err
+}
 
-	if usingFallback {
-		fmt.Printf("Certificates saved to fallback directory: %s\n", certPath)
-		fmt.Printf("Please manually copy certificates to: %s\n", config.CertPath)
-		fmt.Printf("Run: sudo cp %s/* %s/\n", certPath, config.CertPath)
-	} else {
-		exec.Command("/usr/syno/sbin/synoservicectl", "--reload", "nginx").Run()
+// checkProfile verifies that the CA offers the certificate profile
+func checkProfile(httpClient *http.Client, dirURL, profile string) error {
+	directory, err := getDirectory(httpClient, dirURL)
+	if err != nil {
+		return err
+	}
+	if _, ok := directory.Meta.Profiles[profile]; ok {
+		return nil
 	}
 
-	return nil
+	if len(directory.Meta.Profiles) == 0 {
+		return fmt.Errorf("CA does not offer certificate profiles (requested %q)", profile)
+	}
+	available := make([]string, 0, len(directory.Meta.Profiles))
+	for name := range directory.Meta.Profiles {
+		available = append(available, name)
+	}
+	sort.Strings(available)
+	return fmt.Errorf("CA does not offer profile %q (available: %s)", profile, strings.Join(available, ", "))
 }
 
 type User struct {
-	Email        string
-	Registration *registration.Resource
+	Email        string                 `json:"email"`
+	Registration *registration.Resource `json:"registration"`
 	key          crypto.PrivateKey
 }
 
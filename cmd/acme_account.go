@@ -0,0 +1,615 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/spf13/cobra"
+)
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "Manage the stored ACME account",
+	Long:  "Show, register, update, roll over or deactivate the ACME account stored for the configured CA and email",
+}
+
+var accountShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the stored account",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := requireAccountConfig()
+
+		user, err := loadAccount(config)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("No account stored for %s at %s\n", config.Email, config.CADirURL)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to load account: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Email:     %s\n", user.Email)
+		fmt.Printf("CA:        %s\n", config.CADirURL)
+		fmt.Printf("Storage:   %s\n", accountDir(config))
+		if user.Registration == nil {
+			fmt.Println("Status:    not registered")
+			return
+		}
+		fmt.Printf("Account:   %s\n", user.Registration.URI)
+
+		client, err := newLegoClient(config, user)
+		if err == nil {
+			var reg *registration.Resource
+			if reg, err = client.Registration.QueryRegistration(); err == nil {
+				user.Registration = reg
+			}
+		}
+		if err != nil {
+			fmt.Printf("Warning: could not query account from CA: %v\n", err)
+		}
+
+		fmt.Printf("Status:    %s\n", user.Registration.Body.Status)
+		fmt.Printf("Contact:   %s\n", strings.Join(user.Registration.Body.Contact, ", "))
+	},
+}
+
+var accountRegisterCmd = &cobra.Command{
+	Use:   "register",
+	Short: "Register a new account or reuse the stored one",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := requireAccountConfig()
+
+		user, err := getAccount(config)
+		if err != nil {
+			fmt.Printf("Account registration failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Account for %s: %s\n", user.Email, user.Registration.URI)
+	},
+}
+
+var accountUpdateContactCmd = &cobra.Command{
+	Use:   "update-contact <email>",
+	Short: "Change the contact email of the stored account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		config := requireAccountConfig()
+
+		if err := updateAccountContact(config, args[0]); err != nil {
+			fmt.Printf("Contact update failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Account contact changed to %s.\n", args[0])
+		fmt.Printf("Set ACME_EMAIL=%s in your configuration to keep using this account.\n", args[0])
+	},
+}
+
+var accountRolloverCmd = &cobra.Command{
+	Use:   "rollover",
+	Short: "Replace the account key with a newly generated one",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := requireAccountConfig()
+
+		if err := rolloverAccount(config); err != nil {
+			fmt.Printf("Key rollover failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Account key rolled over successfully.")
+	},
+}
+
+var accountDeactivateYes bool
+
+var accountDeactivateCmd = &cobra.Command{
+	Use:   "deactivate",
+	Short: "Permanently deactivate the stored account",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := requireAccountConfig()
+
+		if !accountDeactivateYes {
+			fmt.Println("Error: deactivation cannot be undone, pass --yes to confirm")
+			os.Exit(1)
+		}
+
+		if err := deactivateAccount(config); err != nil {
+			fmt.Printf("Deactivation failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Account for %s deactivated and removed from %s.\n", config.Email, config.StateDir)
+	},
+}
+
+// requireAccountConfig returns the ACME configuration or exits when no email is configured
+func requireAccountConfig() AcmeConfig {
+	config := getAcmeConfig()
+	if config.Email == "" {
+		fmt.Println("Error: ACME_EMAIL environment variable is required")
+		os.Exit(1)
+	}
+	if err := validateAcmeConfig(config); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	return config
+}
+
+// accountDir returns where the account for the configured CA and email is stored
+func accountDir(config AcmeConfig) string {
+	return filepath.Join(config.StateDir, "accounts", caDirName(config.CADirURL), config.Email)
+}
+
+// caDirName turns a CA directory URL into a directory name
+func caDirName(dirURL string) string {
+	name := dirURL
+	if u, err := url.Parse(dirURL); err == nil && u.Host != "" {
+		name = u.Host + u.Path
+	}
+	name = strings.Trim(name, "/")
+	return strings.NewReplacer("/", "_", ":", "_").Replace(name)
+}
+
+// loadAccount reads the stored account. The error wraps os.ErrNotExist when no account is stored.
+func loadAccount(config AcmeConfig) (*User, error) {
+	dir := accountDir(config)
+
+	keyPEM, err := os.ReadFile(filepath.Join(dir, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+	key, err := certcrypto.ParsePEMPrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse account key: %v", err)
+	}
+
+	user := &User{Email: config.Email, key: key}
+
+	data, err := os.ReadFile(filepath.Join(dir, "account.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, user); err != nil {
+		return nil, fmt.Errorf("failed to parse account: %v", err)
+	}
+	return user, nil
+}
+
+// saveAccount writes the account key and registration with owner-only permissions
+func saveAccount(config AcmeConfig, user *User) error {
+	dir := accountDir(config)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create account directory: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "account.key"), certcrypto.PEMEncode(user.key), 0600); err != nil {
+		return fmt.Errorf("failed to write account key: %v", err)
+	}
+
+	if user.Registration == nil {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "account.json"), data, 0600); err != nil {
+		return fmt.Errorf("failed to write account: %v", err)
+	}
+	return nil
+}
+
+// newAccountKey generates a private key of the configured type for an ACME account
+func newAccountKey(config AcmeConfig) (crypto.PrivateKey, error) {
+	if err := validateKeyType(config.AccountKeyType); err != nil {
+		return nil, fmt.Errorf("account key: %v", err)
+	}
+	return certcrypto.GeneratePrivateKey(config.AccountKeyType)
+}
+
+// newLegoConfig returns the lego configuration for the configured CA.
+// A configured CA bundle is trusted in addition to the system roots.
+func newLegoConfig(config AcmeConfig, user *User) (*lego.Config, error) {
+	legoConfig := lego.NewConfig(user)
+	legoConfig.CADirURL = config.CADirURL
+	legoConfig.Certificate.KeyType = config.KeyType
+
+	if config.CABundle != "" {
+		pool, err := lego.CreateCertPool([]string{config.CABundle}, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA bundle: %v", err)
+		}
+		transport, ok := legoConfig.HTTPClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, errors.New("unexpected HTTP transport")
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	return legoConfig, nil
+}
+
+// newLegoClient returns a lego client for the configured CA acting as user
+func newLegoClient(config AcmeConfig, user *User) (*lego.Client, error) {
+	legoConfig, err := newLegoConfig(config, user)
+	if err != nil {
+		return nil, err
+	}
+	return lego.NewClient(legoConfig)
+}
+
+// accountMu serializes getAccount, so certificates issued in parallel share one
+// account instead of each registering and storing their own
+var accountMu sync.Mutex
+
+// getAccount loads the stored account and registers a new one if none exists yet
+func getAccount(config AcmeConfig) (*User, error) {
+	accountMu.Lock()
+	defer accountMu.Unlock()
+
+	user, err := loadAccount(config)
+	if errors.Is(err, os.ErrNotExist) {
+		key, keyErr := newAccountKey(config)
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		user = &User{Email: config.Email, key: key}
+		// Persist the key before registering so a registered account is never lost
+		err = saveAccount(config, user)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Registration != nil {
+		return finishRollover(config, user)
+	}
+
+	client, err := newLegoClient(config, user)
+	if err != nil {
+		return nil, err
+	}
+
+	var reg *registration.Resource
+	if config.EABKeyID != "" {
+		reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: true,
+			Kid:                  config.EABKeyID,
+			HmacEncoded:          config.EABHMAC,
+		})
+	} else {
+		reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.Registration = reg
+
+	if err := saveAccount(config, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// loadRegisteredAccount loads the stored account and a client for it
+func loadRegisteredAccount(config AcmeConfig) (*User, *lego.Client, error) {
+	user, err := loadAccount(config)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("no account stored for %s, run 'acme account register' first", config.Email)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Registration == nil {
+		return nil, nil, fmt.Errorf("account for %s is not registered, run 'acme account register' first", config.Email)
+	}
+	if user, err = finishRollover(config, user); err != nil {
+		return nil, nil, err
+	}
+
+	client, err := newLegoClient(config, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, client, nil
+}
+
+// updateAccountContact changes the account contact and moves the stored account to the new email
+func updateAccountContact(config AcmeConfig, email string) error {
+	user, client, err := loadRegisteredAccount(config)
+	if err != nil {
+		return err
+	}
+
+	user.Email = email
+	reg, err := client.Registration.UpdateRegistration(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		return err
+	}
+	user.Registration = reg
+
+	newConfig := config
+	newConfig.Email = email
+	if err := saveAccount(newConfig, user); err != nil {
+		return err
+	}
+	if accountDir(newConfig) != accountDir(config) {
+		return os.RemoveAll(accountDir(config))
+	}
+	return nil
+}
+
+// rolloverAccount replaces the account key following RFC 8555 section 7.3.5
+func rolloverAccount(config AcmeConfig) error {
+	user, _, err := loadRegisteredAccount(config)
+	if err != nil {
+		return err
+	}
+
+	newKey, err := newAccountKey(config)
+	if err != nil {
+		return err
+	}
+
+	// Keep the new key next to the account until the CA confirmed the change
+	pendingKey := filepath.Join(accountDir(config), pendingAccountKey)
+	if err := os.WriteFile(pendingKey, certcrypto.PEMEncode(newKey), 0600); err != nil {
+		return fmt.Errorf("failed to write new account key: %v", err)
+	}
+
+	legoConfig, err := newLegoConfig(config, user)
+	if err != nil {
+		os.Remove(pendingKey)
+		return err
+	}
+	if err := changeAccountKey(legoConfig.HTTPClient, config.CADirURL, user.Registration.URI, user.key, newKey); err != nil {
+		os.Remove(pendingKey)
+		return err
+	}
+
+	user.key = newKey
+	if err := saveAccount(config, user); err != nil {
+		return err
+	}
+	return os.Remove(pendingKey)
+}
+
+// pendingAccountKey holds the new key of a rollover until it is stored as account.key
+const pendingAccountKey = "account.key.new"
+
+// finishRollover settles a rollover that was interrupted before the new key was
+// stored. When the CA knows the account by the pending key, the change was
+// accepted and the key replaces the stored one, otherwise it is discarded.
+func finishRollover(config AcmeConfig, user *User) (*User, error) {
+	pendingKey := filepath.Join(accountDir(config), pendingAccountKey)
+	keyPEM, err := os.ReadFile(pendingKey)
+	if errors.Is(err, os.ErrNotExist) {
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A key that was not fully written was never sent to the CA
+	key, err := certcrypto.ParsePEMPrivateKey(keyPEM)
+	if err != nil {
+		return user, os.Remove(pendingKey)
+	}
+
+	client, err := newLegoClient(config, &User{Email: user.Email, key: key})
+	if err != nil {
+		return nil, err
+	}
+	reg, err := client.Registration.ResolveAccountByKey()
+	var problem *acme.ProblemDetails
+	if errors.As(err, &problem) && problem.Type == "urn:ietf:params:acme:error:accountDoesNotExist" {
+		fmt.Println("Discarding the account key of an unfinished rollover, the CA did not accept it")
+		return user, os.Remove(pendingKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the account key of an unfinished rollover: %v", err)
+	}
+	if reg.URI != user.Registration.URI {
+		return nil, fmt.Errorf("the pending account key %s belongs to another account (%s)", pendingKey, reg.URI)
+	}
+
+	fmt.Println("Finishing the interrupted account key rollover")
+	user.key = key
+	if err := saveAccount(config, user); err != nil {
+		return nil, err
+	}
+	return user, os.Remove(pendingKey)
+}
+
+// deactivateAccount deactivates the account at the CA and removes it locally
+func deactivateAccount(config AcmeConfig) error {
+	_, client, err := loadRegisteredAccount(config)
+	if err != nil {
+		return err
+	}
+
+	if err := client.Registration.DeleteRegistration(); err != nil {
+		return err
+	}
+	return os.RemoveAll(accountDir(config))
+}
+
+// changeAccountKey sends a keyChange request signed by the old and the new account key
+func changeAccountKey(httpClient *http.Client, dirURL, accountURL string, oldKey, newKey crypto.PrivateKey) error {
+	directory, nonce, err := getDirectoryNonce(httpClient, dirURL)
+	if err != nil {
+		return err
+	}
+	if directory.KeyChangeURL == "" {
+		return errors.New("CA does not support key rollover")
+	}
+
+	oldPublic, err := publicKey(oldKey)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]any{
+		"account": accountURL,
+		"oldKey":  jose.JSONWebKey{Key: oldPublic},
+	})
+	if err != nil {
+		return err
+	}
+
+	inner, err := signJWS(newKey, payload, map[jose.HeaderKey]any{"url": directory.KeyChangeURL}, true)
+	if err != nil {
+		return err
+	}
+	outer, err := signJWS(oldKey, []byte(inner), map[jose.HeaderKey]any{
+		"url":   directory.KeyChangeURL,
+		"nonce": nonce,
+		"kid":   accountURL,
+	}, false)
+	if err != nil {
+		return err
+	}
+
+	if err := postJWS(httpClient, directory.KeyChangeURL, outer); err != nil {
+		return fmt.Errorf("keyChange returned %v", err)
+	}
+	return nil
+}
+
+// getDirectory fetches the ACME directory
+func getDirectory(httpClient *http.Client, dirURL string) (acme.Directory, error) {
+	var directory acme.Directory
+
+	resp, err := httpClient.Get(dirURL)
+	if err != nil {
+		return directory, fmt.Errorf("failed to get directory: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&directory); err != nil {
+		return directory, fmt.Errorf("failed to parse directory: %v", err)
+	}
+	return directory, nil
+}
+
+// getDirectoryNonce fetches the ACME directory and a fresh nonce
+func getDirectoryNonce(httpClient *http.Client, dirURL string) (acme.Directory, string, error) {
+	directory, err := getDirectory(httpClient, dirURL)
+	if err != nil {
+		return directory, "", err
+	}
+
+	nonceResp, err := httpClient.Head(directory.NewNonceURL)
+	if err != nil {
+		return directory, "", fmt.Errorf("failed to get nonce: %v", err)
+	}
+	nonceResp.Body.Close()
+	nonce := nonceResp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return directory, "", errors.New("CA did not return a nonce")
+	}
+	return directory, nonce, nil
+}
+
+// postJWS posts a signed request and returns an error for any status but 200 OK
+func postJWS(httpClient *http.Client, endpoint, body string) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// signJWS signs payload with key using the flattened JSON serialization
+func signJWS(key crypto.PrivateKey, payload []byte, headers map[jose.HeaderKey]any, embedJWK bool) (string, error) {
+	alg, err := jwsAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, &jose.SignerOptions{
+		EmbedJWK:     embedJWK,
+		ExtraHeaders: headers,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return signed.FullSerialize(), nil
+}
+
+// jwsAlgorithm returns the JWS algorithm matching an account key
+func jwsAlgorithm(key crypto.PrivateKey) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported account key type %T", key)
+}
+
+// publicKey returns the public part of a private key
+func publicKey(key crypto.PrivateKey) (crypto.PublicKey, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer.Public(), nil
+}
+
+func init() {
+	accountDeactivateCmd.Flags().BoolVar(&accountDeactivateYes, "yes", false, "Confirm the deactivation")
+
+	accountCmd.AddCommand(accountShowCmd)
+	accountCmd.AddCommand(accountRegisterCmd)
+	accountCmd.AddCommand(accountUpdateContactCmd)
+	accountCmd.AddCommand(accountRolloverCmd)
+	accountCmd.AddCommand(accountDeactivateCmd)
+	acmeCmd.AddCommand(accountCmd)
+}
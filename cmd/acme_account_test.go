@@ -0,0 +1,310 @@
+package cmd
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/go-jose/go-jose/v4"
+)
+
+func TestCADirName(t *testing.T) {
+	tests := map[string]string{
+		"https://acme-v02.api.letsencrypt.org/directory": "acme-v02.api.letsencrypt.org_directory",
+		"https://localhost:14000/dir":                    "localhost_14000_dir",
+	}
+
+	for dirURL, expected := range tests {
+		if name := caDirName(dirURL); name != expected {
+			t.Errorf("Expected '%s' for %s, got '%s'", expected, dirURL, name)
+		}
+	}
+}
+
+func TestSaveLoadAccount(t *testing.T) {
+	config := AcmeConfig{
+		Email:    "test@example.com",
+		StateDir: t.TempDir(),
+		CADirURL: "https://acme-staging-v02.api.letsencrypt.org/directory",
+	}
+
+	if _, err := loadAccount(config); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected not exist error, got %v", err)
+	}
+
+	config.AccountKeyType = certcrypto.EC256
+	key, err := newAccountKey(config)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	user := &User{
+		Email:        config.Email,
+		key:          key,
+		Registration: &registration.Resource{URI: "https://ca.example/acct/1"},
+	}
+
+	if err := saveAccount(config, user); err != nil {
+		t.Fatalf("Failed to save account: %v", err)
+	}
+
+	for _, name := range []string{"account.key", "account.json"} {
+		info, err := os.Stat(filepath.Join(accountDir(config), name))
+		if err != nil {
+			t.Fatalf("Expected %s to exist: %v", name, err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s permissions 0600, got %o", name, info.Mode().Perm())
+		}
+	}
+
+	loaded, err := loadAccount(config)
+	if err != nil {
+		t.Fatalf("Failed to load account: %v", err)
+	}
+	if loaded.Registration == nil || loaded.Registration.URI != "https://ca.example/acct/1" {
+		t.Errorf("Expected stored registration, got %+v", loaded.Registration)
+	}
+	if _, err := jwsAlgorithm(loaded.key); err != nil {
+		t.Errorf("Expected usable account key: %v", err)
+	}
+}
+
+func TestNewAccountKeyType(t *testing.T) {
+	key, err := newAccountKey(AcmeConfig{AccountKeyType: certcrypto.RSA2048})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if alg, _ := jwsAlgorithm(key); alg != jose.RS256 {
+		t.Errorf("Expected RS256 account key, got %s", alg)
+	}
+
+	if _, err := newAccountKey(AcmeConfig{AccountKeyType: "P521"}); err == nil {
+		t.Error("Expected error for unsupported account key type")
+	}
+}
+
+func TestNewLegoConfigCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(bundle, certcrypto.PEMEncode(certcrypto.DERCertificateBytes(server.Certificate().Raw)), 0644)
+
+	legoConfig, err := newLegoConfig(AcmeConfig{CADirURL: server.URL, KeyType: certcrypto.EC256, CABundle: bundle}, &User{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	resp, err := legoConfig.HTTPClient.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected CA bundle to be trusted: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestChangeAccountKey(t *testing.T) {
+	oldKey, _ := newAccountKey(AcmeConfig{AccountKeyType: certcrypto.EC256})
+	newKey, _ := newAccountKey(AcmeConfig{AccountKeyType: certcrypto.EC256})
+	oldPublic, _ := publicKey(oldKey)
+	newPublic, _ := publicKey(newKey)
+
+	var server *httptest.Server
+	var verified bool
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dir":
+			json.NewEncoder(w).Encode(acme.Directory{
+				NewNonceURL:  server.URL + "/nonce",
+				KeyChangeURL: server.URL + "/key-change",
+			})
+		case "/nonce":
+			w.Header().Set("Replay-Nonce", "nonce-1")
+		case "/key-change":
+			body, _ := io.ReadAll(r.Body)
+			outer, err := jose.ParseSigned(string(body), []jose.SignatureAlgorithm{jose.ES256})
+			if err != nil {
+				t.Errorf("Failed to parse outer JWS: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if outer.Signatures[0].Protected.KeyID != server.URL+"/acct/1" || outer.Signatures[0].Protected.Nonce != "nonce-1" {
+				t.Errorf("Unexpected outer header: %+v", outer.Signatures[0].Protected)
+			}
+			innerPayload, err := outer.Verify(oldPublic)
+			if err != nil {
+				t.Errorf("Outer JWS not signed by old key: %v", err)
+			}
+
+			inner, err := jose.ParseSigned(string(innerPayload), []jose.SignatureAlgorithm{jose.ES256})
+			if err != nil {
+				t.Errorf("Failed to parse inner JWS: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if _, err := inner.Verify(newPublic); err != nil {
+				t.Errorf("Inner JWS not signed by new key: %v", err)
+			}
+			verified = true
+		}
+	}))
+	defer server.Close()
+
+	err := changeAccountKey(server.Client(), server.URL+"/dir", server.URL+"/acct/1", oldKey, newKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !verified {
+		t.Error("Expected keyChange request to be sent")
+	}
+}
+
+func TestGetAccountConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	registrations := 0
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/dir":
+			json.NewEncoder(w).Encode(acme.Directory{
+				NewNonceURL:   server.URL + "/nonce",
+				NewAccountURL: server.URL + "/new-acct",
+				NewOrderURL:   server.URL + "/new-order",
+			})
+		case "/new-acct":
+			mu.Lock()
+			registrations++
+			mu.Unlock()
+			w.Header().Set("Location", server.URL+"/acct/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"status":"valid"}`))
+		}
+	}))
+	defer server.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(bundle, certcrypto.PEMEncode(certcrypto.DERCertificateBytes(server.Certificate().Raw)), 0644)
+
+	config := AcmeConfig{
+		Email:          "admin@example.com",
+		StateDir:       t.TempDir(),
+		CADirURL:       server.URL + "/dir",
+		CABundle:       bundle,
+		AccountKeyType: certcrypto.EC256,
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := getAccount(config); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if registrations != 1 {
+		t.Errorf("Expected one registration, got %d", registrations)
+	}
+}
+
+func TestFinishRollover(t *testing.T) {
+	accepted, _ := newAccountKey(AcmeConfig{AccountKeyType: certcrypto.EC256})
+	acceptedPublic, _ := publicKey(accepted)
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/dir":
+			json.NewEncoder(w).Encode(acme.Directory{
+				NewNonceURL:   server.URL + "/nonce",
+				NewAccountURL: server.URL + "/new-acct",
+				NewOrderURL:   server.URL + "/new-order",
+			})
+		case "/new-acct":
+			body, _ := io.ReadAll(r.Body)
+			signed, err := jose.ParseSigned(string(body), []jose.SignatureAlgorithm{jose.ES256})
+			if err != nil {
+				t.Errorf("Failed to parse JWS: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if jwk := signed.Signatures[0].Protected.JSONWebKey; jwk == nil || !acceptedPublic.(interface{ Equal(crypto.PublicKey) bool }).Equal(jwk.Key) {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"type":"urn:ietf:params:acme:error:accountDoesNotExist","detail":"No account exists with the provided key"}`))
+				return
+			}
+			w.Header().Set("Location", server.URL+"/acct/1")
+			w.Write([]byte(`{"status":"valid"}`))
+		}
+	}))
+	defer server.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(bundle, certcrypto.PEMEncode(certcrypto.DERCertificateBytes(server.Certificate().Raw)), 0644)
+
+	for _, accept := range []bool{true, false} {
+		config := AcmeConfig{
+			Email:          "admin@example.com",
+			StateDir:       t.TempDir(),
+			CADirURL:       server.URL + "/dir",
+			CABundle:       bundle,
+			AccountKeyType: certcrypto.EC256,
+		}
+		oldKey, _ := newAccountKey(config)
+		pending, _ := newAccountKey(config)
+		expected := oldKey
+		if accept {
+			pending, expected = accepted, accepted
+		}
+		saveAccount(config, &User{Email: config.Email, key: oldKey, Registration: &registration.Resource{URI: server.URL + "/acct/1"}})
+		os.WriteFile(filepath.Join(accountDir(config), pendingAccountKey), certcrypto.PEMEncode(pending), 0600)
+
+		user, err := getAccount(config)
+		if err != nil {
+			t.Fatalf("Unexpected error (accepted %v): %v", accept, err)
+		}
+		stored, _ := loadAccount(config)
+		key := expected.(interface{ Equal(crypto.PrivateKey) bool })
+		if !key.Equal(user.key) || !key.Equal(stored.key) {
+			t.Errorf("Unexpected account key after recovery (accepted %v)", accept)
+		}
+		if _, err := os.Stat(filepath.Join(accountDir(config), pendingAccountKey)); !os.IsNotExist(err) {
+			t.Errorf("Expected the pending key to be removed (accepted %v)", accept)
+		}
+	}
+}
+
+func TestCheckProfile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(acme.Directory{Meta: acme.Meta{Profiles: map[string]string{
+			"classic":    "The same profile you're accustomed to",
+			"shortlived": "A short-lived profile",
+		}}})
+	}))
+	defer server.Close()
+
+	if err := checkProfile(server.Client(), server.URL, "shortlived"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	err := checkProfile(server.Client(), server.URL, "tlsclient")
+	if err == nil || !strings.Contains(err.Error(), "classic, shortlived") {
+		t.Errorf("Expected error listing available profiles, got %v", err)
+	}
+}
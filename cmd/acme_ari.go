@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+// renewalState is the renewal time chosen for an installed certificate
+type renewalState struct {
+	CertID         string    `json:"cert_id"`
+	WindowStart    time.Time `json:"window_start"`
+	WindowEnd      time.Time `json:"window_end"`
+	RenewAt        time.Time `json:"renew_at"`
+	CheckedAt      time.Time `json:"checked_at"`
+	NextCheck      time.Time `json:"next_check,omitzero"`
+	ExplanationURL string    `json:"explanation_url,omitempty"`
+}
+
+// renewalInfoFunc queries the suggested renewal window of a certificate
+type renewalInfoFunc func(leaf *x509.Certificate) (*certificate.RenewalInfoResponse, error)
+
+// renewalStateMu serializes updates of the renewal state files
+var renewalStateMu sync.Mutex
+
+// ariSchedule returns a renewal schedule following the renewal window the CA
+// suggests through ACME Renewal Information (RFC 9773). A random point inside the
+// window is chosen once and kept in the state directory until the window changes.
+// The CA is not asked again before the Retry-After time of its last answer.
+func ariSchedule(stateDir string, getInfo renewalInfoFunc) renewalSchedule {
+	return func(cert CertificateConfig, leaf *x509.Certificate, now time.Time) (time.Time, error) {
+		certID, err := certificate.MakeARICertID(leaf)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("ARI unavailable: %v", err)
+		}
+
+		path := renewalStatePath(stateDir, cert.Name)
+		renewalStateMu.Lock()
+		states, err := loadRenewalStates(path)
+		renewalStateMu.Unlock()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if state, ok := states[certID]; ok && now.Before(state.NextCheck) {
+			return state.RenewAt, nil
+		}
+
+		info, err := getInfo(leaf)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("ARI unavailable: %v", err)
+		}
+		start, end := info.SuggestedWindow.Start.UTC(), info.SuggestedWindow.End.UTC()
+		if end.Before(start) {
+			return time.Time{}, errors.New("ARI unavailable: invalid suggested window")
+		}
+
+		renewalStateMu.Lock()
+		defer renewalStateMu.Unlock()
+
+		if states, err = loadRenewalStates(path); err != nil {
+			return time.Time{}, err
+		}
+
+		state, ok := states[certID]
+		if !ok || !state.WindowStart.Equal(start) || !state.WindowEnd.Equal(end) {
+			state = renewalState{CertID: certID, WindowStart: start, WindowEnd: end, RenewAt: start}
+			if window := end.Sub(start); window > 0 {
+				state.RenewAt = start.Add(rand.N(window))
+			}
+			fmt.Printf("[%s] Renewal window %s to %s, renewing at %s\n", cert.Name,
+				start.Format(time.RFC3339), end.Format(time.RFC3339), state.RenewAt.Format(time.RFC3339))
+			if info.ExplanationURL != "" {
+				fmt.Printf("[%s] CA explanation: %s\n", cert.Name, info.ExplanationURL)
+			}
+		}
+		state.CheckedAt = now.UTC()
+		state.ExplanationURL = info.ExplanationURL
+		state.NextCheck = time.Time{}
+		if info.RetryAfter > 0 {
+			state.NextCheck = now.UTC().Add(info.RetryAfter)
+		}
+
+		// Only the certificates installed now are kept
+		current := map[string]renewalState{certID: state}
+		for id, s := range states {
+			if id != certID && s.WindowEnd.After(now) && !s.CheckedAt.Before(now.Add(-7*24*time.Hour)) {
+				current[id] = s
+			}
+		}
+		if err := saveRenewalStates(path, current); err != nil {
+			return time.Time{}, err
+		}
+		return state.RenewAt, nil
+	}
+}
+
+// installedCertID returns the ARI certificate ID of the installed certificate
+// variant, or an empty string when none can be read
+func installedCertID(cert CertificateConfig, variant certificateVariant) string {
+	leaf, err := readInstalledCertificate(filepath.Join(cert.installedDir(), variantFileName(cert.certFile(), variant.Suffix)))
+	if err != nil {
+		return ""
+	}
+	certID, err := certificate.MakeARICertID(leaf)
+	if err != nil {
+		return ""
+	}
+	return certID
+}
+
+// renewalStatePath returns the state file of a certificate
+func renewalStatePath(stateDir, name string) string {
+	return filepath.Join(stateDir, "renewal", name+".json")
+}
+
+// loadRenewalStates reads the renewal states of a certificate keyed by ARI certificate ID
+func loadRenewalStates(path string) (map[string]renewalState, error) {
+	states := map[string]renewalState{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return states, nil
+}
+
+// saveRenewalStates writes the renewal states of a certificate
+func saveRenewalStates(path string, states map[string]renewalState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+func TestARISchedule(t *testing.T) {
+	stateDir := t.TempDir()
+	_, leafPEM, _ := newTestChain(t, "nas.example.com")
+	leaf, _ := certcrypto.ParsePEMCertificate(leafPEM)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	window := acme.Window{Start: now.Add(10 * 24 * time.Hour), End: now.Add(12 * 24 * time.Hour)}
+	schedule := ariSchedule(stateDir, func(*x509.Certificate) (*certificate.RenewalInfoResponse, error) {
+		return &certificate.RenewalInfoResponse{RenewalInfoResponse: acme.RenewalInfoResponse{SuggestedWindow: window}}, nil
+	})
+	cert := CertificateConfig{Name: "nas"}
+
+	renewAt, err := schedule(cert, leaf, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if renewAt.Before(window.Start) || !renewAt.Before(window.End) {
+		t.Errorf("Expected renewal time inside the window, got %s", renewAt)
+	}
+
+	again, _ := schedule(cert, leaf, now.Add(time.Hour))
+	if !again.Equal(renewAt) {
+		t.Errorf("Expected stored renewal time %s, got %s", renewAt, again)
+	}
+
+	states, err := loadRenewalStates(renewalStatePath(stateDir, "nas"))
+	if err != nil || len(states) != 1 {
+		t.Fatalf("Expected one stored state, got %v (%v)", states, err)
+	}
+
+	window = acme.Window{Start: now.Add(-time.Hour), End: now}
+	moved, _ := schedule(cert, leaf, now)
+	if moved.After(now) {
+		t.Errorf("Expected renewal time inside the new window, got %s", moved)
+	}
+}
+
+func TestRenewalReasonARI(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "nas.cer"), newTestCertificate(t, key, []string{"nas.example.com"}, time.Now().Add(20*24*time.Hour)), 0644)
+	cert := CertificateConfig{Name: "nas", Domains: []string{"nas.example.com"}, Path: dir, KeyType: certcrypto.EC256, RenewDays: 30}
+
+	due := func(CertificateConfig, *x509.Certificate, time.Time) (time.Time, error) {
+		return time.Now().Add(-time.Minute), nil
+	}
+	if reason, _ := renewalReason(cert, time.Now(), due); !strings.Contains(reason, "renewal time") {
+		t.Errorf("Expected ARI renewal, got '%s'", reason)
+	}
+
+	later := func(CertificateConfig, *x509.Certificate, time.Time) (time.Time, error) {
+		return time.Now().Add(time.Hour), nil
+	}
+	if reason, _ := renewalReason(cert, time.Now(), later); reason != "" {
+		t.Errorf("Expected ARI to override the renewal window, got '%s'", reason)
+	}
+
+	unavailable := func(CertificateConfig, *x509.Certificate, time.Time) (time.Time, error) {
+		return time.Time{}, errors.New("ARI unavailable")
+	}
+	if reason, _ := renewalReason(cert, time.Now(), unavailable); !strings.Contains(reason, "expires in") {
+		t.Errorf("Expected fallback to the renewal window, got '%s'", reason)
+	}
+}
+
+func TestRenewReplaceInstalled(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "nas.cer"), newTestCertificate(t, key, []string{"nas.example.com"}, time.Now().Add(20*24*time.Hour)), 0644)
+	cert := CertificateConfig{Name: "nas", Domains: []string{"nas.example.com"}, Path: dir, KeyType: certcrypto.EC256, RenewDays: 30}
+
+	due := func(CertificateConfig, *x509.Certificate, time.Time) (time.Time, error) {
+		return time.Now().Add(-time.Minute), nil
+	}
+	later := func(CertificateConfig, *x509.Certificate, time.Time) (time.Time, error) {
+		return time.Now().Add(time.Hour), nil
+	}
+	unavailable := func(CertificateConfig, *x509.Certificate, time.Time) (time.Time, error) {
+		return time.Time{}, errors.New("ARI unavailable")
+	}
+	changed := cert
+	changed.Domains = []string{"nas.example.com", "files.example.com"}
+
+	for _, test := range []struct {
+		name     string
+		cert     CertificateConfig
+		schedule renewalSchedule
+		replace  bool
+	}{
+		{"renewal time", cert, due, true},
+		{"domains changed", changed, later, false},
+		{"ARI error", cert, unavailable, false},
+	} {
+		replaced := false
+		results := renewCertificates([]CertificateConfig{test.cert}, false, 1, test.schedule, func(cert CertificateConfig) error {
+			replaced = cert.ReplaceInstalled
+			return nil
+		})
+		if results[0].Status != "issued" {
+			t.Errorf("%s: expected renewal, got %s (%s)", test.name, results[0].Status, results[0].Detail)
+		}
+		if replaced != test.replace {
+			t.Errorf("%s: expected ReplaceInstalled %v, got %v", test.name, test.replace, replaced)
+		}
+	}
+}
+
+func TestARIScheduleRetryAfter(t *testing.T) {
+	_, leafPEM, _ := newTestChain(t, "nas.example.com")
+	leaf, _ := certcrypto.ParsePEMCertificate(leafPEM)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	queries := 0
+	schedule := ariSchedule(t.TempDir(), func(*x509.Certificate) (*certificate.RenewalInfoResponse, error) {
+		queries++
+		return &certificate.RenewalInfoResponse{
+			RenewalInfoResponse: acme.RenewalInfoResponse{SuggestedWindow: acme.Window{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour)}},
+			RetryAfter:          6 * time.Hour,
+		}, nil
+	})
+	cert := CertificateConfig{Name: "nas"}
+
+	renewAt, _ := schedule(cert, leaf, now)
+	if again, _ := schedule(cert, leaf, now.Add(time.Hour)); queries != 1 || !again.Equal(renewAt) {
+		t.Errorf("Expected the stored renewal time before Retry-After, got %d queries", queries)
+	}
+	schedule(cert, leaf, now.Add(7*time.Hour))
+	if queries != 2 {
+		t.Errorf("Expected a new query after Retry-After, got %d queries", queries)
+	}
+}
+
+func TestInstalledCertID(t *testing.T) {
+	dir := t.TempDir()
+	_, leafPEM, _ := newTestChain(t, "nas.example.com")
+	leaf, _ := certcrypto.ParsePEMCertificate(leafPEM)
+	cert := CertificateConfig{Name: "nas", Path: dir}
+	variant := certificateVariant{KeyType: certcrypto.EC256}
+
+	if id := installedCertID(cert, variant); id != "" {
+		t.Errorf("Expected no ID without an installed certificate, got %s", id)
+	}
+	os.WriteFile(filepath.Join(dir, cert.certFile()), leafPEM, 0644)
+	expected, _ := certificate.MakeARICertID(leaf)
+	if id := installedCertID(cert, variant); id != expected {
+		t.Errorf("Expected %s, got %s", expected, id)
+	}
+}
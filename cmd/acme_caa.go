@@ -0,0 +1,358 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+var (
+	caaUpdate         bool
+	caaAccountBinding bool
+)
+
+// caaData is a CAA record as stored by Cloudflare
+type caaData struct {
+	Flags int    `json:"flags"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+func (c caaData) String() string {
+	return fmt.Sprintf("%d %s %q", c.Flags, c.Tag, c.Value)
+}
+
+// caaLookupFunc returns the CAA records at name, following CNAMEs
+type caaLookupFunc func(name string) ([]caaData, error)
+
+var caaCmd = &cobra.Command{
+	Use:   "caa [name...]",
+	Short: "Check or update the CAA records of the managed domains",
+	Long: `Check that the CAA records of all managed domains authorize the configured CA.
+
+With --update the CAA records at the domains are created or updated through the
+Cloudflare API. The records name the CA and, unless --account-binding=false is
+given, bind issuance to the stored ACME account with the accounturi parameter.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, certs := requireIssueConfig(args)
+
+		user, err := getAccount(config)
+		if err != nil {
+			fmt.Printf("Failed to get ACME account: %v\n", err)
+			os.Exit(1)
+		}
+		identities, err := caIdentities(config, user)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(identities) == 0 {
+			fmt.Printf("Error: %s does not publish CAA identities\n", config.CADirURL)
+			os.Exit(1)
+		}
+
+		accountURI := ""
+		if user.Registration != nil {
+			accountURI = user.Registration.URI
+		}
+
+		if caaUpdate {
+			binding := ""
+			if caaAccountBinding {
+				binding = accountURI
+			}
+			client, err := newCloudflareClient()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			for _, cert := range certs {
+				if err := updateCAARecords(client, cert, identities, binding); err != nil {
+					fmt.Printf("CAA update for %s failed: %v\n", cert.Name, err)
+					os.Exit(1)
+				}
+			}
+		}
+
+		failed := false
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DOMAIN\tSTATUS\tCAA")
+		for _, cert := range certs {
+			lookup := newCAALookup(cert.DNSResolvers)
+			for _, domain := range cert.Domains {
+				owner, records, err := relevantCAA(domain, lookup)
+				if err == nil {
+					err = checkCAA(domain, owner, records, identities, accountURI, cert.challenge())
+				}
+
+				status := "ok"
+				if err != nil {
+					status, failed = err.Error(), true
+				}
+				detail := "none"
+				if len(records) > 0 {
+					var values []string
+					for _, record := range records {
+						values = append(values, record.String())
+					}
+					detail = owner + ": " + strings.Join(values, ", ")
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", domain, status, detail)
+			}
+		}
+		tw.Flush()
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// challenge returns the challenge type of the certificate
+func (c CertificateConfig) challenge() string {
+	if c.Challenge == "" {
+		return challengeDNS01
+	}
+	return c.Challenge
+}
+
+// caIdentities returns the domain names the CA recognizes in CAA records
+func caIdentities(config AcmeConfig, user *User) ([]string, error) {
+	legoConfig, err := newLegoConfig(config, user)
+	if err != nil {
+		return nil, err
+	}
+	directory, err := getDirectory(legoConfig.HTTPClient, config.CADirURL)
+	if err != nil {
+		return nil, err
+	}
+	return directory.Meta.CaaIdentities, nil
+}
+
+// checkCertificateCAA fails when the CAA records of a domain of cert do not
+// authorize the CA. Failed lookups are only reported, as the CA checks again.
+func checkCertificateCAA(config AcmeConfig, user *User, cert CertificateConfig) error {
+	identities, err := caIdentities(config, user)
+	if err != nil {
+		return err
+	}
+	if len(identities) == 0 {
+		return nil
+	}
+
+	accountURI := ""
+	if user.Registration != nil {
+		accountURI = user.Registration.URI
+	}
+
+	lookup := newCAALookup(cert.DNSResolvers)
+	for _, domain := range cert.Domains {
+		owner, records, err := relevantCAA(domain, lookup)
+		if err != nil {
+			fmt.Printf("[%s] CAA lookup for %s failed: %v\n", cert.Name, domain, err)
+			continue
+		}
+		if err := checkCAA(domain, owner, records, identities, accountURI, cert.challenge()); err != nil {
+			return fmt.Errorf("%v, run acme caa --update to authorize it", err)
+		}
+	}
+	return nil
+}
+
+// relevantCAA walks from domain towards the root and returns the first non-empty
+// CAA record set and the name it was found at (RFC 8659 section 3)
+func relevantCAA(domain string, lookup caaLookupFunc) (string, []caaData, error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(domain), "*."), ".")
+	for name != "" {
+		records, err := lookup(name)
+		if err != nil {
+			return name, nil, err
+		}
+		if len(records) > 0 {
+			return name, records, nil
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return "", nil, nil
+}
+
+// checkCAA checks whether the relevant CAA records of domain authorize one of
+// the CA identities for the account and validation method
+func checkCAA(domain, owner string, records []caaData, identities []string, accountURI, method string) error {
+	tag := "issue"
+	if strings.HasPrefix(domain, "*.") && slices.ContainsFunc(records, func(r caaData) bool { return strings.EqualFold(r.Tag, "issuewild") }) {
+		tag = "issuewild"
+	}
+
+	var properties []caaData
+	for _, record := range records {
+		switch strings.ToLower(record.Tag) {
+		case tag:
+			properties = append(properties, record)
+		case "issue", "issuewild", "iodef", "issuemail", "issuevmc":
+		default:
+			if record.Flags&128 != 0 {
+				return fmt.Errorf("CAA records at %s contain the unknown critical property %s", owner, record.Tag)
+			}
+		}
+	}
+	if len(properties) == 0 {
+		return nil
+	}
+
+	for _, property := range properties {
+		issuer, params := parseCAAValue(property.Value)
+		if !slices.ContainsFunc(identities, func(id string) bool { return strings.EqualFold(id, issuer) }) {
+			continue
+		}
+		if uri, ok := params["accounturi"]; ok && uri != accountURI {
+			continue
+		}
+		if methods, ok := params["validationmethods"]; ok && !slices.Contains(strings.Split(methods, ","), method) {
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("CAA %s records at %s do not authorize %s for this account and %s", tag, owner, identities[0], method)
+}
+
+// parseCAAValue splits the value of an issue or issuewild property into the issuer
+// domain and its parameters
+func parseCAAValue(value string) (string, map[string]string) {
+	issuer, rest, _ := strings.Cut(value, ";")
+	params := map[string]string{}
+	for _, param := range strings.Split(rest, ";") {
+		if key, value, found := strings.Cut(strings.TrimSpace(param), "="); found {
+			params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+	}
+	return strings.TrimSpace(issuer), params
+}
+
+// updateCAARecords creates or updates the CAA records at the domains of cert so
+// they authorize the first CA identity, bound to accountURI when it is set
+func updateCAARecords(client *cloudflareClient, cert CertificateConfig, identities []string, accountURI string) error {
+	value := identities[0]
+	if accountURI != "" {
+		value += "; accounturi=" + accountURI
+	}
+
+	for _, domain := range cert.Domains {
+		name := strings.TrimPrefix(strings.ToLower(domain), "*.")
+		zoneID, err := client.zoneID(name)
+		if err != nil {
+			return err
+		}
+		records, err := client.records(zoneID, "CAA", name)
+		if err != nil {
+			return err
+		}
+
+		existing := make([]caaData, len(records))
+		for i, record := range records {
+			if err := json.Unmarshal(record.Data, &existing[i]); err != nil {
+				return fmt.Errorf("failed to parse CAA record %s: %v", name, err)
+			}
+		}
+
+		// Wildcards are covered by issue unless issuewild records exist
+		tag := "issue"
+		if strings.HasPrefix(domain, "*.") && slices.ContainsFunc(existing, func(r caaData) bool { return strings.EqualFold(r.Tag, "issuewild") }) {
+			tag = "issuewild"
+		}
+		want := caaData{Tag: tag, Value: value}
+
+		var match *cloudflareRecord
+		var matchData caaData
+		for i, data := range existing {
+			issuer, _ := parseCAAValue(data.Value)
+			if !strings.EqualFold(data.Tag, tag) || !slices.ContainsFunc(identities, func(id string) bool { return strings.EqualFold(id, issuer) }) {
+				continue
+			}
+			if match == nil || data == want {
+				match, matchData = &records[i], data
+			}
+		}
+
+		data, err := json.Marshal(want)
+		if err != nil {
+			return err
+		}
+		switch {
+		case match == nil:
+			err = client.createRecord(zoneID, cloudflareRecord{Type: "CAA", Name: name, Data: data, TTL: 1})
+		case matchData != want:
+			err = client.updateRecord(zoneID, cloudflareRecord{ID: match.ID, Type: "CAA", Name: name, Data: data, TTL: 1})
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[%s] Set %s CAA %s\n", cert.Name, name, want)
+	}
+	return nil
+}
+
+// newCAALookup returns a CAA lookup using the resolvers, or the system resolvers
+func newCAALookup(resolvers []string) caaLookupFunc {
+	if len(resolvers) == 0 {
+		if config, err := dns.ClientConfigFromFile("/etc/resolv.conf"); err == nil {
+			for _, server := range config.Servers {
+				resolvers = append(resolvers, net.JoinHostPort(server, config.Port))
+			}
+		}
+	}
+	if len(resolvers) == 0 {
+		resolvers = []string{"8.8.8.8:53", "8.8.4.4:53"}
+	}
+
+	return func(name string) ([]caaData, error) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(name), dns.TypeCAA)
+		msg.SetEdns0(4096, false)
+
+		var err error
+		for _, resolver := range resolvers {
+			if !strings.Contains(resolver, ":") {
+				resolver = net.JoinHostPort(resolver, "53")
+			}
+
+			var in *dns.Msg
+			in, _, err = new(dns.Client).Exchange(msg, resolver)
+			if err == nil && in.Truncated {
+				in, _, err = (&dns.Client{Net: "tcp"}).Exchange(msg, resolver)
+			}
+			if err != nil {
+				continue
+			}
+
+			switch in.Rcode {
+			case dns.RcodeSuccess, dns.RcodeNameError:
+				var records []caaData
+				for _, answer := range in.Answer {
+					if caa, ok := answer.(*dns.CAA); ok {
+						records = append(records, caaData{Flags: int(caa.Flag), Tag: caa.Tag, Value: caa.Value})
+					}
+				}
+				return records, nil
+			default:
+				err = fmt.Errorf("%s returned %s for %s", resolver, dns.RcodeToString[in.Rcode], name)
+			}
+		}
+		return nil, err
+	}
+}
+
+func init() {
+	caaCmd.Flags().BoolVar(&caaUpdate, "update", false, "Create or update the CAA records through the Cloudflare API")
+	caaCmd.Flags().BoolVar(&caaAccountBinding, "account-binding", true, "Bind the CAA records to the stored ACME account (accounturi)")
+	acmeCmd.AddCommand(caaCmd)
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRelevantCAA(t *testing.T) {
+	zone := map[string][]caaData{
+		"example.com":          {{Tag: "issue", Value: "letsencrypt.org"}},
+		"shop.example.com":     {{Tag: "issue", Value: "sectigo.com"}},
+		"broken.example.com":   nil,
+		"x.broken.example.com": nil,
+	}
+	lookup := func(name string) ([]caaData, error) {
+		if name == "broken.example.com" {
+			return nil, errors.New("SERVFAIL")
+		}
+		return zone[name], nil
+	}
+
+	tests := []struct {
+		domain string
+		owner  string
+	}{
+		{"nas.example.com", "example.com"},
+		{"*.nas.example.com", "example.com"},
+		{"a.shop.example.com", "shop.example.com"},
+		{"example.org", ""},
+	}
+	for _, tt := range tests {
+		owner, _, err := relevantCAA(tt.domain, lookup)
+		if err != nil || owner != tt.owner {
+			t.Errorf("Expected CAA of %s at %q, got %q (%v)", tt.domain, tt.owner, owner, err)
+		}
+	}
+
+	if _, _, err := relevantCAA("x.broken.example.com", lookup); err == nil {
+		t.Error("Expected lookup error")
+	}
+}
+
+func TestCheckCAA(t *testing.T) {
+	identities := []string{"letsencrypt.org"}
+	account := "https://acme-v02.api.letsencrypt.org/acme/acct/1"
+
+	tests := []struct {
+		name    string
+		domain  string
+		records []caaData
+		allowed bool
+	}{
+		{"no records", "nas.example.com", nil, true},
+		{"iodef only", "nas.example.com", []caaData{{Tag: "iodef", Value: "mailto:admin@example.com"}}, true},
+		{"issuer", "nas.example.com", []caaData{{Tag: "issue", Value: "LetsEncrypt.org"}}, true},
+		{"other issuer", "nas.example.com", []caaData{{Tag: "issue", Value: "sectigo.com"}}, false},
+		{"no issuer", "nas.example.com", []caaData{{Tag: "issue", Value: ";"}}, false},
+		{"account", "nas.example.com", []caaData{{Tag: "issue", Value: "letsencrypt.org; accounturi=" + account}}, true},
+		{"other account", "nas.example.com", []caaData{{Tag: "issue", Value: "letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/2"}}, false},
+		{"validation method", "nas.example.com", []caaData{{Tag: "issue", Value: "letsencrypt.org; validationmethods=http-01"}}, false},
+		{"wildcard issue", "*.nas.example.com", []caaData{{Tag: "issue", Value: "letsencrypt.org"}}, true},
+		{"wildcard issuewild", "*.nas.example.com", []caaData{{Tag: "issue", Value: "letsencrypt.org"}, {Tag: "issuewild", Value: "sectigo.com"}}, false},
+		{"critical property", "nas.example.com", []caaData{{Flags: 128, Tag: "tbs", Value: "x"}, {Tag: "issue", Value: "letsencrypt.org"}}, false},
+	}
+	for _, tt := range tests {
+		err := checkCAA(tt.domain, "example.com", tt.records, identities, account, challengeDNS01)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s: expected allowed=%v, got %v", tt.name, tt.allowed, err)
+		}
+	}
+}
+
+func TestUpdateCAARecords(t *testing.T) {
+	fake := newFakeCloudflare(t)
+	other, _ := json.Marshal(caaData{Tag: "issue", Value: "sectigo.com"})
+	old, _ := json.Marshal(caaData{Tag: "issue", Value: "letsencrypt.org"})
+	fake.records = []cloudflareRecord{
+		{ID: "other", Type: "CAA", Name: "nas.example.com", Data: other},
+		{ID: "old", Type: "CAA", Name: "nas.example.com", Data: old},
+	}
+
+	client, err := newCloudflareClient()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cert := CertificateConfig{Name: "nas", Domains: []string{"nas.example.com", "*.nas.example.com", "photos.example.com"}}
+	account := "https://acme-v02.api.letsencrypt.org/acme/acct/1"
+	if err := updateCAARecords(client, cert, []string{"letsencrypt.org"}, account); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	values := map[string][]string{}
+	for _, record := range fake.records {
+		var data caaData
+		json.Unmarshal(record.Data, &data)
+		values[record.Name] = append(values[record.Name], data.Tag+" "+data.Value)
+	}
+	want := "issue letsencrypt.org; accounturi=" + account
+	if got := strings.Join(values["nas.example.com"], "|"); got != "issue sectigo.com|"+want {
+		t.Errorf("Expected the existing record to be updated, got %s", got)
+	}
+	if got := strings.Join(values["photos.example.com"], "|"); got != want {
+		t.Errorf("Expected a new record, got %s", got)
+	}
+}
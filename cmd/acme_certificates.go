@@ -0,0 +1,572 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+const deployFiles = "files"
+
+// CertificateConfig describes a managed certificate
+type CertificateConfig struct {
+	Name        string
+	Domains     []string
+	KeyType     certcrypto.KeyType
+	DualKeyType certcrypto.KeyType
+	Path        string
+	Challenge   string
+	DNSProvider string
+
+	ChallengeAlias        map[string]string
+	DNSResolvers          []string
+	DNSPropagationTimeout time.Duration
+	DNSPollingInterval    time.Duration
+	DNSSkipPreCheck       bool
+	DNSPropagationWait    time.Duration
+
+	HTTPPort    string
+	HTTPWebroot string
+	TLSPort     string
+	Profile     string
+	ReuseKey    bool
+	KeyFile     string
+	CSR         string
+	Deploy      []string
+	Outputs     []certificateOutput
+	PreDeploy   string
+	PostDeploy  string
+	HookTimeout time.Duration
+	RenewDays   int
+
+	// ReplaceInstalled names the installed certificate as replaced in the order,
+	// set for renewals triggered by the ARI renewal time
+	ReplaceInstalled bool
+
+	PKCS12Password string
+	PKCS12Encoding string
+
+	BackupDir    string
+	Backups      int
+	FallbackFile string
+
+	Verify           map[string]deployVerification
+	VerifyServerName string
+	VerifyTimeout    time.Duration
+
+	TLSA          []string
+	TLSAUsages    []int
+	TLSADelay     time.Duration
+	TLSAWait      time.Duration
+	TLSAStateFile string
+
+	SynologyRoot    string
+	SynologyDesc    string
+	SynologyDefault bool
+	SynologyReload  map[string][]Hook
+}
+
+// certificateVariant is one key type of a certificate and the suffix of its files
+type certificateVariant struct {
+	KeyType certcrypto.KeyType
+	Suffix  string
+}
+
+// variants returns the primary key type and, with dual issuance, the second one
+func (c CertificateConfig) variants() []certificateVariant {
+	variants := []certificateVariant{{KeyType: c.KeyType}}
+	if c.DualKeyType != "" {
+		variants = append(variants, certificateVariant{KeyType: c.DualKeyType, Suffix: keyFamily(c.DualKeyType)})
+	}
+	return variants
+}
+
+// variantFileName inserts the variant suffix before the file extension,
+// so "privkey.pem" of the RSA variant becomes "privkey.rsa.pem"
+func variantFileName(filename, suffix string) string {
+	if suffix == "" {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + suffix + ext
+}
+
+// certificateResult is the outcome of issuing or renewing one certificate
+type certificateResult struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+var keyTypes = map[string]certcrypto.KeyType{
+	"EC256":   certcrypto.EC256,
+	"EC384":   certcrypto.EC384,
+	"RSA2048": certcrypto.RSA2048,
+	"RSA3072": certcrypto.RSA3072,
+	"RSA4096": certcrypto.RSA4096,
+}
+
+// parseKeyType converts a key type name such as "EC256" or "RSA2048" into a lego key type
+func parseKeyType(name string) (certcrypto.KeyType, error) {
+	if keyType, ok := keyTypes[strings.ToUpper(strings.TrimSpace(name))]; ok {
+		return keyType, nil
+	}
+	return "", fmt.Errorf("unsupported key type %q (use EC256, EC384, RSA2048, RSA3072 or RSA4096)", name)
+}
+
+// envKeyType returns the key type named by an environment variable or a default value if unset.
+// Unknown names are kept as they are so validateKeyType can report them.
+func envKeyType(key string, defaultValue certcrypto.KeyType) certcrypto.KeyType {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	if keyType, err := parseKeyType(value); err == nil {
+		return keyType
+	}
+	return certcrypto.KeyType(value)
+}
+
+// validateKeyType checks that keyType is one of the supported key types
+func validateKeyType(keyType certcrypto.KeyType) error {
+	for _, t := range keyTypes {
+		if t == keyType {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported key type %q (use EC256, EC384, RSA2048, RSA3072 or RSA4096)", keyType)
+}
+
+// keyFamily returns "ecdsa" or "rsa" for a key type
+func keyFamily(keyType certcrypto.KeyType) string {
+	if keyType == certcrypto.EC256 || keyType == certcrypto.EC384 {
+		return "ecdsa"
+	}
+	return "rsa"
+}
+
+// keyTypeName returns the configuration name of a lego key type
+func keyTypeName(keyType certcrypto.KeyType) string {
+	for name, t := range keyTypes {
+		if t == keyType {
+			return name
+		}
+	}
+	return string(keyType)
+}
+
+// getCertificates returns the managed certificates. ACME_CERTIFICATES lists
+// their names and each one is configured with ACME_CERT_<NAME>_* variables.
+// Without ACME_CERTIFICATES the certificate defined by ACME_DOMAINS is managed.
+func getCertificates(config AcmeConfig) ([]CertificateConfig, error) {
+	names := getEnvList("ACME_CERTIFICATES")
+	if len(names) == 0 {
+		if len(config.Domains) == 0 {
+			return nil, nil
+		}
+		cert := CertificateConfig{
+			Name:        config.CertName,
+			Domains:     config.Domains,
+			KeyType:     config.KeyType,
+			DualKeyType: config.DualKeyType,
+			Path:        config.CertPath,
+			Challenge:   config.Challenge,
+			DNSProvider: config.DNSProvider,
+
+			DNSResolvers:          config.DNSResolvers,
+			DNSPropagationTimeout: config.DNSPropagationTimeout,
+			DNSPollingInterval:    config.DNSPollingInterval,
+			DNSSkipPreCheck:       config.DNSSkipPreCheck,
+			DNSPropagationWait:    config.DNSPropagationWait,
+
+			HTTPPort:    config.HTTPPort,
+			HTTPWebroot: config.HTTPWebroot,
+			TLSPort:     config.TLSPort,
+			Profile:     config.Profile,
+			ReuseKey:    config.ReuseKey,
+			KeyFile:     config.KeyFile,
+			CSR:         config.CSR,
+			Deploy:      config.Deploy,
+			PreDeploy:   config.PreDeploy,
+			PostDeploy:  config.PostDeploy,
+			HookTimeout: config.HookTimeout,
+			RenewDays:   config.RenewDays,
+
+			PKCS12Password: config.PKCS12Password,
+			PKCS12Encoding: config.PKCS12Encoding,
+
+			BackupDir:    filepath.Join(config.StateDir, "backups", config.CertName),
+			Backups:      config.Backups,
+			FallbackFile: filepath.Join(config.StateDir, "fallback", config.CertName),
+
+			VerifyServerName: getEnv("ACME_VERIFY_SERVERNAME", ""),
+			VerifyTimeout:    config.VerifyTimeout,
+
+			TLSADelay:     config.TLSADelay,
+			TLSAWait:      config.TLSAWait,
+			TLSAStateFile: filepath.Join(config.StateDir, "tlsa", config.CertName+".json"),
+
+			SynologyRoot:    config.SynologyRoot,
+			SynologyDesc:    getEnv("ACME_SYNOLOGY_DESC", config.CertName),
+			SynologyDefault: getEnvBool("ACME_SYNOLOGY_DEFAULT", false),
+		}
+		if len(cert.Deploy) == 0 {
+			cert.Deploy = []string{deployFiles}
+		}
+		if err := validateDeployTargets(cert); err != nil {
+			return nil, err
+		}
+		if err := setSynologyReloads(&cert, config.SynologyReload); err != nil {
+			return nil, err
+		}
+		if err := getVerifications(&cert, "ACME_"); err != nil {
+			return nil, err
+		}
+		if err := applyKeySource(&cert); err != nil {
+			return nil, err
+		}
+		if err := setChallengeAliases(&cert, config.ChallengeAlias); err != nil {
+			return nil, err
+		}
+		if err := setTLSA(&cert, config.TLSA, config.TLSAUsage); err != nil {
+			return nil, err
+		}
+		if err := setOutputs(&cert, config.Outputs); err != nil {
+			return nil, err
+		}
+		if err := validateKeyTypes(cert); err != nil {
+			return nil, err
+		}
+		if err := validateChallenge(cert); err != nil {
+			return nil, err
+		}
+		return []CertificateConfig{cert}, nil
+	}
+
+	certs := make([]CertificateConfig, 0, len(names))
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("certificate %s is defined twice", name)
+		}
+		seen[name] = true
+
+		prefix := "ACME_CERT_" + envName(name) + "_"
+		cert := CertificateConfig{
+			Name:        name,
+			Domains:     getEnvList(prefix + "DOMAINS"),
+			KeyType:     envKeyType(prefix+"KEY_TYPE", config.KeyType),
+			DualKeyType: envKeyType(prefix+"DUAL_KEY_TYPE", config.DualKeyType),
+			Path:        getEnv(prefix+"PATH", ""),
+			Challenge:   strings.ToLower(getEnv(prefix+"CHALLENGE", config.Challenge)),
+			DNSProvider: getEnv(prefix+"DNS_PROVIDER", config.DNSProvider),
+
+			DNSResolvers:          getEnvList(prefix + "DNS_RESOLVERS"),
+			DNSPropagationTimeout: getEnvDuration(prefix+"DNS_PROPAGATION_TIMEOUT", config.DNSPropagationTimeout),
+			DNSPollingInterval:    getEnvDuration(prefix+"DNS_POLLING_INTERVAL", config.DNSPollingInterval),
+			DNSSkipPreCheck:       getEnvBool(prefix+"DNS_SKIP_PRECHECK", config.DNSSkipPreCheck),
+			DNSPropagationWait:    getEnvDuration(prefix+"DNS_PROPAGATION_WAIT", config.DNSPropagationWait),
+
+			HTTPPort:    getEnv(prefix+"HTTP_PORT", config.HTTPPort),
+			HTTPWebroot: getEnv(prefix+"HTTP_WEBROOT", config.HTTPWebroot),
+			TLSPort:     getEnv(prefix+"TLS_PORT", config.TLSPort),
+			Profile:     getEnv(prefix+"PROFILE", config.Profile),
+			ReuseKey:    getEnvBool(prefix+"REUSE_KEY", config.ReuseKey),
+			KeyFile:     getEnv(prefix+"KEY_FILE", ""),
+			CSR:         getEnv(prefix+"CSR", ""),
+
+			TLSADelay:     getEnvDuration(prefix+"TLSA_DELAY", config.TLSADelay),
+			TLSAWait:      getEnvDuration(prefix+"TLSA_WAIT", config.TLSAWait),
+			TLSAStateFile: filepath.Join(config.StateDir, "tlsa", name+".json"),
+		}
+
+		if err := applyKeySource(&cert); err != nil {
+			return nil, err
+		}
+		if len(cert.Domains) == 0 {
+			return nil, fmt.Errorf("certificate %s: %sDOMAINS or %sCSR is required", name, prefix, prefix)
+		}
+		if len(cert.DNSResolvers) == 0 {
+			cert.DNSResolvers = config.DNSResolvers
+		}
+		aliases := getEnvList(prefix + "CHALLENGE_ALIAS")
+		if len(aliases) == 0 {
+			aliases = config.ChallengeAlias
+		}
+		if err := setChallengeAliases(&cert, aliases); err != nil {
+			return nil, err
+		}
+		if cert.Path == "" {
+			return nil, fmt.Errorf("certificate %s: %sPATH is required", name, prefix)
+		}
+		if err := validateKeyTypes(cert); err != nil {
+			return nil, err
+		}
+		if err := validateChallenge(cert); err != nil {
+			return nil, err
+		}
+		if err := setDeploySettings(&cert, config, prefix, config.StateDir); err != nil {
+			return nil, err
+		}
+		tlsa := getEnvList(prefix + "TLSA")
+		if len(tlsa) == 0 {
+			tlsa = config.TLSA
+		}
+		usages := getEnvList(prefix + "TLSA_USAGE")
+		if len(usages) == 0 {
+			usages = config.TLSAUsage
+		}
+		if err := setTLSA(&cert, tlsa, usages); err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// setDeploySettings reads how a certificate of the inventory is deployed
+// and renewed from <prefix>* variables, falling back to the ACME defaults.
+// Backups and the fallback directory record are kept below stateDir.
+func setDeploySettings(cert *CertificateConfig, config AcmeConfig, prefix, stateDir string) error {
+	cert.Deploy = getEnvList(prefix + "DEPLOY")
+	cert.PreDeploy = getEnv(prefix+"PRE_DEPLOY", config.PreDeploy)
+	cert.PostDeploy = getEnv(prefix+"POST_DEPLOY", config.PostDeploy)
+	cert.HookTimeout = getEnvDuration(prefix+"HOOK_TIMEOUT", config.HookTimeout)
+	cert.RenewDays = getEnvInt(prefix+"RENEW_DAYS", config.RenewDays)
+
+	cert.PKCS12Password = getEnv(prefix+"PKCS12_PASSWORD", config.PKCS12Password)
+	cert.PKCS12Encoding = strings.ToLower(getEnv(prefix+"PKCS12_ENCODING", config.PKCS12Encoding))
+
+	cert.BackupDir = filepath.Join(stateDir, "backups", cert.Name)
+	cert.Backups = getEnvInt(prefix+"BACKUPS", config.Backups)
+	cert.FallbackFile = filepath.Join(stateDir, "fallback", cert.Name)
+
+	cert.VerifyServerName = getEnv(prefix+"VERIFY_SERVERNAME", "")
+	cert.VerifyTimeout = getEnvDuration(prefix+"VERIFY_TIMEOUT", config.VerifyTimeout)
+
+	cert.SynologyRoot = config.SynologyRoot
+	cert.SynologyDesc = getEnv(prefix+"SYNOLOGY_DESC", cert.Name)
+	cert.SynologyDefault = getEnvBool(prefix+"SYNOLOGY_DEFAULT", false)
+
+	if len(cert.Deploy) == 0 {
+		cert.Deploy = config.Deploy
+	}
+	if len(cert.Deploy) == 0 {
+		cert.Deploy = []string{deployFiles}
+	}
+	if err := validateDeployTargets(*cert); err != nil {
+		return err
+	}
+	if err := setSynologyReloads(cert, config.SynologyReload); err != nil {
+		return err
+	}
+	if err := getVerifications(cert, prefix); err != nil {
+		return err
+	}
+
+	outputs := getEnvList(prefix + "OUTPUTS")
+	if len(outputs) == 0 {
+		outputs = config.Outputs
+	}
+	return setOutputs(cert, outputs)
+}
+
+// validateDeployTargets checks that all deploy targets of a certificate are known
+func validateDeployTargets(cert CertificateConfig) error {
+	for _, target := range cert.Deploy {
+		if target != deployFiles && target != deploySynology {
+			return fmt.Errorf("certificate %s: unknown deploy target %q (use files or synology)", cert.Name, target)
+		}
+	}
+	return nil
+}
+
+// setSynologyReloads parses the reload commands of DSM services
+func setSynologyReloads(cert *CertificateConfig, values []string) error {
+	reloads, err := parseSynologyReloads(values)
+	if err != nil {
+		return fmt.Errorf("certificate %s: %v", cert.Name, err)
+	}
+	cert.SynologyReload = reloads
+	return nil
+}
+
+// setChallengeAliases parses the challenge aliases of a certificate
+func setChallengeAliases(cert *CertificateConfig, values []string) error {
+	aliases, err := parseChallengeAliases(values)
+	if err != nil {
+		return fmt.Errorf("certificate %s: %v", cert.Name, err)
+	}
+	cert.ChallengeAlias = aliases
+	return nil
+}
+
+// setTLSA parses the TLSA endpoints and usages of a certificate
+func setTLSA(cert *CertificateConfig, values, usages []string) error {
+	names, err := parseTLSANames(values, cert.Domains)
+	if err != nil {
+		return fmt.Errorf("certificate %s: %v", cert.Name, err)
+	}
+	if len(usages) == 0 {
+		usages = []string{"3"}
+	}
+	parsed, err := parseTLSAUsages(usages)
+	if err != nil {
+		return fmt.Errorf("certificate %s: %v", cert.Name, err)
+	}
+	cert.TLSA, cert.TLSAUsages = names, parsed
+	return nil
+}
+
+// setOutputs parses the outputs of a certificate, falling back to the default files
+func setOutputs(cert *CertificateConfig, values []string) error {
+	if len(values) == 0 {
+		for _, value := range defaultOutputs(cert.Name) {
+			// Without a key only the certificate files can be written
+			if cert.hasKey() || !strings.HasPrefix(value, outputKey) {
+				values = append(values, value)
+			}
+		}
+	}
+	outputs, err := parseOutputs(cert.Name, values)
+	if err != nil {
+		return fmt.Errorf("certificate %s: %v", cert.Name, err)
+	}
+	cert.Outputs = outputs
+	return validateOutputs(*cert)
+}
+
+// validateKeyTypes checks the key types of a certificate. A dual issuance key type
+// must belong to the other key family so both variants can be told apart.
+func validateKeyTypes(cert CertificateConfig) error {
+	if err := validateKeyType(cert.KeyType); err != nil {
+		return fmt.Errorf("certificate %s: %v", cert.Name, err)
+	}
+	if cert.DualKeyType == "" {
+		return nil
+	}
+	if err := validateKeyType(cert.DualKeyType); err != nil {
+		return fmt.Errorf("certificate %s: dual issuance: %v", cert.Name, err)
+	}
+	if keyFamily(cert.DualKeyType) == keyFamily(cert.KeyType) {
+		return fmt.Errorf("certificate %s: dual issuance needs one ECDSA and one RSA key type, got %s and %s",
+			cert.Name, keyTypeName(cert.KeyType), keyTypeName(cert.DualKeyType))
+	}
+	return nil
+}
+
+// selectCertificates returns the certificates with the given names or all when names is empty
+func selectCertificates(certs []CertificateConfig, names []string) ([]CertificateConfig, error) {
+	if len(names) == 0 {
+		return certs, nil
+	}
+
+	selected := make([]CertificateConfig, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, cert := range certs {
+			if cert.Name == name {
+				selected = append(selected, cert)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown certificate %q", name)
+		}
+	}
+	return selected, nil
+}
+
+// renewCertificates renews every certificate that is due according to schedule
+// (or all when force is set) running at most concurrency issuances at the same time
+func renewCertificates(certs []CertificateConfig, force bool, concurrency int, schedule renewalSchedule, issue func(CertificateConfig) error) []certificateResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]certificateResult, len(certs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, cert := range certs {
+		wg.Add(1)
+		go func(i int, cert CertificateConfig) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = renewOne(cert, force, schedule, issue)
+		}(i, cert)
+	}
+
+	wg.Wait()
+	return results
+}
+
+func renewOne(cert CertificateConfig, force bool, schedule renewalSchedule, issue func(CertificateConfig) error) certificateResult {
+	result := certificateResult{Name: cert.Name}
+
+	// Replaced TLSA records are removed once their delay has passed, also when nothing is renewed
+	if len(cert.TLSA) > 0 {
+		if err := removeDueTLSA(cert, time.Now()); err != nil {
+			fmt.Printf("[%s] Failed to remove replaced TLSA records: %v\n", cert.Name, err)
+		}
+	}
+
+	// A previous run that died while installing is finished before the files are checked
+	if err := completeInstall(cert, cert.installedDir()); err != nil {
+		result.Status, result.Detail = "failed", err.Error()
+		return result
+	}
+
+	reason := "forced renewal"
+	if !force {
+		var err error
+		reason, err = renewalReason(cert, time.Now(), schedule)
+		if err != nil {
+			result.Status, result.Detail = "failed", err.Error()
+			return result
+		}
+		if reason == "" {
+			result.Status, result.Detail = "skipped", "up to date"
+			return result
+		}
+	}
+
+	fmt.Printf("Issuing certificate %s for domains %s: %s\n", cert.Name, strings.Join(cert.Domains, ", "), reason)
+
+	// Changed domains or key types, forced renewals and the RenewDays fallback replace nothing the CA scheduled
+	cert.ReplaceInstalled = schedule != nil && scheduledRenewal(reason)
+
+	if err := issue(cert); err != nil {
+		result.Status, result.Detail = "failed", err.Error()
+		return result
+	}
+
+	result.Status, result.Detail = "issued", reason
+	return result
+}
+
+// printCertificateResults writes a summary table and reports whether any certificate failed
+func printCertificateResults(w io.Writer, results []certificateResult) bool {
+	failed := false
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tDETAIL")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Name, result.Status, result.Detail)
+		if result.Status == "failed" {
+			failed = true
+		}
+	}
+	tw.Flush()
+	return failed
+}
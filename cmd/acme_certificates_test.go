@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+func TestGetCertificatesDefault(t *testing.T) {
+	config := AcmeConfig{
+		Domains:    []string{"nas.example.com"},
+		CertName:   "nas.example.com",
+		CertPath:   "/tmp/cert",
+		KeyType:    certcrypto.EC256,
+		RenewDays:  30,
+		PostDeploy: "reload",
+	}
+
+	certs, err := getCertificates(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(certs) != 1 || certs[0].Name != "nas.example.com" || certs[0].Path != "/tmp/cert" {
+		t.Errorf("Expected single default certificate, got %+v", certs)
+	}
+}
+
+func TestGetCertificatesInventory(t *testing.T) {
+	env := map[string]string{
+		"ACME_CERTIFICATES":                   "dsm,reverse-proxy",
+		"ACME_CERT_DSM_DOMAINS":               "nas.example.com,*.nas.example.com",
+		"ACME_CERT_DSM_PATH":                  "/usr/syno/etc/certificate/system/default",
+		"ACME_CERT_REVERSE_PROXY_DOMAINS":     "proxy.example.com",
+		"ACME_CERT_REVERSE_PROXY_PATH":        "/volume1/docker/proxy/certs",
+		"ACME_CERT_REVERSE_PROXY_KEY_TYPE":    "rsa2048",
+		"ACME_CERT_REVERSE_PROXY_POST_DEPLOY": "docker restart proxy",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	certs, err := getCertificates(AcmeConfig{KeyType: certcrypto.EC256, RenewDays: 30, PostDeploy: "reload"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("Expected 2 certificates, got %d", len(certs))
+	}
+
+	if len(certs[0].Domains) != 2 || certs[0].KeyType != certcrypto.EC256 || certs[0].PostDeploy != "reload" {
+		t.Errorf("Unexpected dsm certificate: %+v", certs[0])
+	}
+	if certs[1].KeyType != certcrypto.RSA2048 || certs[1].PostDeploy != "docker restart proxy" {
+		t.Errorf("Unexpected reverse-proxy certificate: %+v", certs[1])
+	}
+	if len(certs[1].Deploy) != 1 || certs[1].Deploy[0] != deployFiles {
+		t.Errorf("Expected default deploy target, got %v", certs[1].Deploy)
+	}
+
+	os.Setenv("ACME_CERT_DSM_KEY_TYPE", "EC521")
+	if _, err := getCertificates(AcmeConfig{KeyType: certcrypto.EC256}); err == nil {
+		t.Error("Expected error for unsupported key type")
+	}
+}
+
+func TestSelectCertificates(t *testing.T) {
+	certs := []CertificateConfig{{Name: "dsm"}, {Name: "proxy"}, {Name: "mail"}}
+
+	selected, err := selectCertificates(certs, []string{"mail", "dsm"})
+	if err != nil || len(selected) != 2 || selected[0].Name != "mail" {
+		t.Errorf("Expected mail and dsm, got %v (%v)", selected, err)
+	}
+
+	if _, err := selectCertificates(certs, []string{"unknown"}); err == nil {
+		t.Error("Expected error for unknown certificate")
+	}
+}
+
+func TestRenewCertificates(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	validDir := t.TempDir()
+	os.WriteFile(filepath.Join(validDir, "valid.cer"), newTestCertificate(t, key, []string{"valid.example.com"}, time.Now().Add(80*24*time.Hour)), 0644)
+
+	certs := []CertificateConfig{
+		{Name: "valid", Domains: []string{"valid.example.com"}, Path: validDir, KeyType: certcrypto.EC256, RenewDays: 30},
+		{Name: "missing", Domains: []string{"missing.example.com"}, Path: t.TempDir(), KeyType: certcrypto.EC256, RenewDays: 30},
+		{Name: "broken", Domains: []string{"broken.example.com"}, Path: t.TempDir(), KeyType: certcrypto.EC256, RenewDays: 30},
+	}
+
+	var running, maxRunning int32
+	results := renewCertificates(certs, false, 2, nil, func(cert CertificateConfig) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if cert.Name == "broken" {
+			return errors.New("dns error")
+		}
+		return nil
+	})
+
+	expected := map[string]string{"valid": "skipped", "missing": "issued", "broken": "failed"}
+	for _, result := range results {
+		if result.Status != expected[result.Name] {
+			t.Errorf("Expected %s to be %s, got %s (%s)", result.Name, expected[result.Name], result.Status, result.Detail)
+		}
+	}
+	if maxRunning > 2 {
+		t.Errorf("Expected at most 2 concurrent issuances, got %d", maxRunning)
+	}
+
+	var out bytes.Buffer
+	if !printCertificateResults(&out, results) {
+		t.Error("Expected failure to be reported")
+	}
+	if !strings.Contains(out.String(), "dns error") {
+		t.Errorf("Expected error detail in summary, got %q", out.String())
+	}
+}
+
+func TestDualKeyTypeVariants(t *testing.T) {
+	cert := CertificateConfig{Name: "nas", KeyType: certcrypto.EC256, DualKeyType: certcrypto.RSA2048}
+	if err := validateKeyTypes(cert); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	variants := cert.variants()
+	if len(variants) != 2 || variants[1].KeyType != certcrypto.RSA2048 || variants[1].Suffix != "rsa" {
+		t.Errorf("Unexpected variants: %+v", variants)
+	}
+
+	if name := variantFileName("privkey.pem", "rsa"); name != "privkey.rsa.pem" {
+		t.Errorf("Expected 'privkey.rsa.pem', got '%s'", name)
+	}
+	if name := variantFileName("nas.example.com.key", ""); name != "nas.example.com.key" {
+		t.Errorf("Expected unchanged primary file name, got '%s'", name)
+	}
+
+	cert.DualKeyType = certcrypto.EC384
+	if err := validateKeyTypes(cert); err == nil {
+		t.Error("Expected error for dual issuance within the same key family")
+	}
+}
+
+func TestRenewalReasonDual(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "nas.cer"), newTestCertificate(t, ecKey, []string{"nas.example.com"}, time.Now().Add(80*24*time.Hour)), 0644)
+
+	cert := CertificateConfig{
+		Name:        "nas",
+		Domains:     []string{"nas.example.com"},
+		Path:        dir,
+		KeyType:     certcrypto.EC256,
+		DualKeyType: certcrypto.RSA2048,
+		RenewDays:   30,
+	}
+
+	reason, err := renewalReason(cert, time.Now(), nil)
+	if err != nil || reason != "rsa no certificate installed" {
+		t.Errorf("Expected missing RSA variant to trigger renewal, got '%s' (%v)", reason, err)
+	}
+}
+
+func TestGetCertificatesDNSProvider(t *testing.T) {
+	os.Setenv("ACME_CERTIFICATES", "public,lab")
+	os.Setenv("ACME_CERT_PUBLIC_DOMAINS", "nas.example.com")
+	os.Setenv("ACME_CERT_PUBLIC_PATH", "/tmp/public")
+	os.Setenv("ACME_CERT_LAB_DOMAINS", "lab.example.net")
+	os.Setenv("ACME_CERT_LAB_PATH", "/tmp/lab")
+	os.Setenv("ACME_CERT_LAB_DNS_PROVIDER", "rfc2136")
+	defer func() {
+		for _, key := range []string{"ACME_CERTIFICATES", "ACME_CERT_PUBLIC_DOMAINS", "ACME_CERT_PUBLIC_PATH",
+			"ACME_CERT_LAB_DOMAINS", "ACME_CERT_LAB_PATH", "ACME_CERT_LAB_DNS_PROVIDER"} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	certs, err := getCertificates(AcmeConfig{KeyType: certcrypto.EC256, DNSProvider: "cloudflare"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if certs[0].DNSProvider != "cloudflare" || certs[1].DNSProvider != "rfc2136" {
+		t.Errorf("Expected cloudflare and rfc2136 providers, got '%s' and '%s'", certs[0].DNSProvider, certs[1].DNSProvider)
+	}
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns"
+	"github.com/go-acme/lego/v4/providers/http/webroot"
+)
+
+const (
+	challengeDNS01     = "dns-01"
+	challengeHTTP01    = "http-01"
+	challengeTLSALPN01 = "tls-alpn-01"
+)
+
+// listenerMu serializes issuances that run a built-in challenge listener
+var listenerMu sync.Mutex
+
+// validateChallenge checks the challenge settings of a certificate, an empty challenge means DNS-01
+func validateChallenge(cert CertificateConfig) error {
+	switch cert.Challenge {
+	case "", challengeDNS01, challengeHTTP01, challengeTLSALPN01:
+		return nil
+	}
+	return fmt.Errorf("certificate %s: unknown challenge %q (use %s, %s or %s)",
+		cert.Name, cert.Challenge, challengeDNS01, challengeHTTP01, challengeTLSALPN01)
+}
+
+// usesListener reports whether the certificate is validated through a built-in listener
+func (c CertificateConfig) usesListener() bool {
+	return c.Challenge == challengeTLSALPN01 || (c.Challenge == challengeHTTP01 && c.HTTPWebroot == "")
+}
+
+// setChallengeProvider configures the challenge selected for cert on client
+func setChallengeProvider(client *lego.Client, cert CertificateConfig) error {
+	switch cert.Challenge {
+	case challengeHTTP01:
+		if cert.HTTPWebroot != "" {
+			provider, err := webroot.NewHTTPProvider(cert.HTTPWebroot)
+			if err != nil {
+				return fmt.Errorf("webroot %s: %v", cert.HTTPWebroot, err)
+			}
+			return client.Challenge.SetHTTP01Provider(provider)
+		}
+		return client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", cert.HTTPPort))
+
+	case challengeTLSALPN01:
+		return client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("", cert.TLSPort))
+
+	default:
+		provider, err := dns.NewDNSChallengeProviderByName(cert.DNSProvider)
+		if err != nil {
+			return fmt.Errorf("DNS provider %s: %v", cert.DNSProvider, err)
+		}
+
+		var opts []dns01.ChallengeOption
+		if len(cert.DNSResolvers) > 0 {
+			opts = append(opts, dns01.AddRecursiveNameservers(cert.DNSResolvers))
+		}
+		// The wait comes before the lookup, or replaces it when the lookup is skipped
+		if cert.DNSSkipPreCheck || cert.DNSPropagationWait > 0 {
+			opts = append(opts, dns01.PropagationWait(cert.DNSPropagationWait, cert.DNSSkipPreCheck))
+		}
+
+		return client.Challenge.SetDNS01Provider(&dnsProvider{
+			provider: provider,
+			aliases:  cert.ChallengeAlias,
+			timeout:  cert.DNSPropagationTimeout,
+			interval: cert.DNSPollingInterval,
+		}, opts...)
+	}
+}
+
+// dnsProvider wraps a lego DNS provider to place challenge records below an
+// alias domain and to override the propagation timeout and polling interval
+type dnsProvider struct {
+	provider challenge.Provider
+	aliases  map[string]string
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// Present creates the TXT record for domain, below its alias if one is configured.
+// The record value only depends on keyAuth, so any name the provider is given works.
+func (p *dnsProvider) Present(domain, token, keyAuth string) error {
+	return p.provider.Present(challengeAlias(p.aliases, domain), token, keyAuth)
+}
+
+// CleanUp removes the TXT record created by Present
+func (p *dnsProvider) CleanUp(domain, token, keyAuth string) error {
+	return p.provider.CleanUp(challengeAlias(p.aliases, domain), token, keyAuth)
+}
+
+// Timeout returns the configured propagation timeout and polling interval,
+// falling back to the values of the wrapped provider
+func (p *dnsProvider) Timeout() (time.Duration, time.Duration) {
+	timeout, interval := dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+	if t, ok := p.provider.(challenge.ProviderTimeout); ok {
+		timeout, interval = t.Timeout()
+	}
+	if p.timeout > 0 {
+		timeout = p.timeout
+	}
+	if p.interval > 0 {
+		interval = p.interval
+	}
+	return timeout, interval
+}
+
+// parseChallengeAliases parses "alias.example.net" for all domains or
+// "domain=alias" entries for single domains
+func parseChallengeAliases(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	aliases := map[string]string{}
+	for _, value := range values {
+		domain, alias, found := strings.Cut(value, "=")
+		if !found {
+			domain, alias = "", value
+		}
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "*."))
+		alias = strings.TrimSuffix(strings.TrimSpace(alias), ".")
+		if alias == "" {
+			return nil, fmt.Errorf("invalid challenge alias %q", value)
+		}
+		aliases[domain] = alias
+	}
+	return aliases, nil
+}
+
+// challengeAlias returns the domain whose _acme-challenge record validates domain.
+// Without an alias this is the domain itself.
+func challengeAlias(aliases map[string]string, domain string) string {
+	if alias, ok := aliases[strings.ToLower(strings.TrimPrefix(domain, "*."))]; ok {
+		return alias
+	}
+	if alias, ok := aliases[""]; ok {
+		return alias
+	}
+	return domain
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+)
+
+func TestValidateChallenge(t *testing.T) {
+	for _, challenge := range []string{"", challengeDNS01, challengeHTTP01, challengeTLSALPN01} {
+		if err := validateChallenge(CertificateConfig{Name: "nas", Challenge: challenge}); err != nil {
+			t.Errorf("Unexpected error for %q: %v", challenge, err)
+		}
+	}
+
+	if err := validateChallenge(CertificateConfig{Name: "nas", Challenge: "dns-02"}); err == nil {
+		t.Error("Expected error for unknown challenge")
+	}
+}
+
+func TestUsesListener(t *testing.T) {
+	tests := []struct {
+		cert     CertificateConfig
+		expected bool
+	}{
+		{CertificateConfig{Challenge: challengeDNS01}, false},
+		{CertificateConfig{Challenge: challengeHTTP01, HTTPPort: "80"}, true},
+		{CertificateConfig{Challenge: challengeHTTP01, HTTPWebroot: "/var/www"}, false},
+		{CertificateConfig{Challenge: challengeTLSALPN01, TLSPort: "443"}, true},
+	}
+
+	for _, tt := range tests {
+		if tt.cert.usesListener() != tt.expected {
+			t.Errorf("Expected usesListener() = %v for %+v", tt.expected, tt.cert)
+		}
+	}
+}
+
+func TestGetCertificatesChallenge(t *testing.T) {
+	os.Setenv("ACME_CERTIFICATES", "printer")
+	os.Setenv("ACME_CERT_PRINTER_DOMAINS", "printer.example.com")
+	os.Setenv("ACME_CERT_PRINTER_PATH", "/tmp/printer")
+	os.Setenv("ACME_CERT_PRINTER_CHALLENGE", "HTTP-01")
+	os.Setenv("ACME_CERT_PRINTER_HTTP_WEBROOT", "/var/www/html")
+	defer func() {
+		for _, key := range []string{"ACME_CERTIFICATES", "ACME_CERT_PRINTER_DOMAINS", "ACME_CERT_PRINTER_PATH",
+			"ACME_CERT_PRINTER_CHALLENGE", "ACME_CERT_PRINTER_HTTP_WEBROOT"} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	certs, err := getCertificates(AcmeConfig{KeyType: certcrypto.EC256, Challenge: challengeDNS01, HTTPPort: "80"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if certs[0].Challenge != challengeHTTP01 || certs[0].HTTPWebroot != "/var/www/html" || certs[0].HTTPPort != "80" {
+		t.Errorf("Unexpected challenge settings: %+v", certs[0])
+	}
+
+	os.Setenv("ACME_CERT_PRINTER_CHALLENGE", "manual")
+	if _, err := getCertificates(AcmeConfig{KeyType: certcrypto.EC256}); err == nil {
+		t.Error("Expected error for unknown challenge")
+	}
+}
+
+type recordingProvider struct {
+	presented []string
+	cleaned   []string
+}
+
+func (p *recordingProvider) Present(domain, token, keyAuth string) error {
+	p.presented = append(p.presented, domain)
+	return nil
+}
+
+func (p *recordingProvider) CleanUp(domain, token, keyAuth string) error {
+	p.cleaned = append(p.cleaned, domain)
+	return nil
+}
+
+func TestParseChallengeAliases(t *testing.T) {
+	aliases, err := parseChallengeAliases([]string{"nas.example.com=nas.validation.example.net", "*.Photos.example.com=photos.validation.example.net."})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := map[string]string{
+		"nas.example.com":      "nas.validation.example.net",
+		"*.nas.example.com":    "nas.validation.example.net",
+		"other.example.com":    "other.example.com",
+		"photos.example.com":   "photos.validation.example.net",
+		"*.photos.example.com": "photos.validation.example.net",
+	}
+	for domain, expected := range tests {
+		if alias := challengeAlias(aliases, domain); alias != expected {
+			t.Errorf("Expected alias %s for %s, got %s", expected, domain, alias)
+		}
+	}
+
+	aliases, err = parseChallengeAliases([]string{"validation.example.net"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if alias := challengeAlias(aliases, "*.nas.example.com"); alias != "validation.example.net" {
+		t.Errorf("Expected default alias, got %s", alias)
+	}
+
+	if _, err := parseChallengeAliases([]string{"nas.example.com="}); err == nil {
+		t.Error("Expected error for empty alias")
+	}
+}
+
+func TestDNSProviderAlias(t *testing.T) {
+	inner := &recordingProvider{}
+	provider := &dnsProvider{
+		provider: inner,
+		aliases:  map[string]string{"nas.example.com": "nas.validation.example.net"},
+		timeout:  5 * time.Minute,
+	}
+
+	provider.Present("nas.example.com", "token", "keyAuth")
+	provider.Present("photos.example.com", "token", "keyAuth")
+	provider.CleanUp("nas.example.com", "token", "keyAuth")
+
+	if len(inner.presented) != 2 || inner.presented[0] != "nas.validation.example.net" || inner.presented[1] != "photos.example.com" {
+		t.Errorf("Unexpected presented domains: %v", inner.presented)
+	}
+	if len(inner.cleaned) != 1 || inner.cleaned[0] != "nas.validation.example.net" {
+		t.Errorf("Unexpected cleaned domains: %v", inner.cleaned)
+	}
+
+	timeout, interval := provider.Timeout()
+	if timeout != 5*time.Minute || interval != dns01.DefaultPollingInterval {
+		t.Errorf("Unexpected timeout %s and interval %s", timeout, interval)
+	}
+}
+
+func TestGetCertificatesChallengeAlias(t *testing.T) {
+	os.Setenv("ACME_CERTIFICATES", "nas")
+	os.Setenv("ACME_CERT_NAS_DOMAINS", "nas.example.com")
+	os.Setenv("ACME_CERT_NAS_PATH", "/tmp/nas")
+	os.Setenv("ACME_CERT_NAS_CHALLENGE_ALIAS", "nas.example.com=nas.validation.example.net")
+	os.Setenv("ACME_CERT_NAS_DNS_PROPAGATION_TIMEOUT", "10m")
+	os.Setenv("ACME_CERT_NAS_DNS_RESOLVERS", "9.9.9.9:53,8.8.8.8:53")
+	defer func() {
+		for _, key := range []string{"ACME_CERTIFICATES", "ACME_CERT_NAS_DOMAINS", "ACME_CERT_NAS_PATH",
+			"ACME_CERT_NAS_CHALLENGE_ALIAS", "ACME_CERT_NAS_DNS_PROPAGATION_TIMEOUT", "ACME_CERT_NAS_DNS_RESOLVERS"} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	certs, err := getCertificates(AcmeConfig{KeyType: certcrypto.EC256, ChallengeAlias: []string{"validation.example.net"},
+		DNSResolvers: []string{"1.1.1.1:53"}, DNSPollingInterval: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cert := certs[0]
+	if challengeAlias(cert.ChallengeAlias, "nas.example.com") != "nas.validation.example.net" {
+		t.Errorf("Expected certificate alias to override the global alias: %v", cert.ChallengeAlias)
+	}
+	if cert.DNSPropagationTimeout != 10*time.Minute || cert.DNSPollingInterval != 10*time.Second || len(cert.DNSResolvers) != 2 {
+		t.Errorf("Unexpected propagation settings: %+v", cert)
+	}
+}
@@ -0,0 +1,394 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// statusMismatch is reported when an endpoint serves another certificate than the managed one
+const statusMismatch = "mismatch"
+
+// STARTTLS protocols of acme check
+const (
+	starttlsNone = "none"
+	starttlsSMTP = "smtp"
+	starttlsIMAP = "imap"
+)
+
+var (
+	checkOutput     string
+	checkWarnDays   int
+	checkServerName string
+	checkStartTLS   string
+	checkCertName   string
+	checkTimeout    time.Duration
+)
+
+// checkOptions configures how an endpoint is checked
+type checkOptions struct {
+	ServerName string
+	StartTLS   string
+	CertName   string
+	Timeout    time.Duration
+	WarnDays   int
+}
+
+// chainEntry is one certificate served by an endpoint
+type chainEntry struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// endpointStatus describes the certificate served by a TLS endpoint
+type endpointStatus struct {
+	Address       string       `json:"address"`
+	ServerName    string       `json:"server_name,omitempty"`
+	Certificate   string       `json:"certificate,omitempty"`
+	Status        string       `json:"status"`
+	Error         string       `json:"error,omitempty"`
+	DNSNames      []string     `json:"dns_names,omitempty"`
+	NotAfter      time.Time    `json:"not_after,omitzero"`
+	DaysRemaining int          `json:"days_remaining"`
+	Serial        string       `json:"serial,omitempty"`
+	Trusted       bool         `json:"trusted"`
+	TrustError    string       `json:"trust_error,omitempty"`
+	Chain         []chainEntry `json:"chain,omitempty"`
+}
+
+var checkCmd = &cobra.Command{
+	Use:   "check host:port [host:port...]",
+	Short: "Check the certificate served by TLS endpoints",
+	Long: `Connect to TLS endpoints and show the served chain, expiry and SANs.
+
+The served certificate is compared with the managed certificate whose domains
+match the server name, or the one given with --cert. The command exits with
+status 1 when an endpoint serves another certificate, cannot be reached or its
+certificate expires within --warn-days. SMTP (ports 25 and 587) and IMAP
+(port 143) endpoints are upgraded with STARTTLS unless --starttls is given.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if checkOutput != outputTable && checkOutput != outputJSON {
+			fmt.Printf("Error: unsupported output %q (use table or json)\n", checkOutput)
+			os.Exit(1)
+		}
+		if checkStartTLS != "" && checkStartTLS != starttlsNone && checkStartTLS != starttlsSMTP && checkStartTLS != starttlsIMAP {
+			fmt.Printf("Error: unsupported STARTTLS protocol %q (use smtp, imap or none)\n", checkStartTLS)
+			os.Exit(1)
+		}
+
+		certs, err := getCertificates(getAcmeConfig())
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		opts := checkOptions{
+			ServerName: checkServerName,
+			StartTLS:   checkStartTLS,
+			CertName:   checkCertName,
+			Timeout:    checkTimeout,
+			WarnDays:   getEnvInt("ACME_WARN_DAYS", defaultWarnDays),
+		}
+		if cmd.Flags().Changed("warn-days") {
+			opts.WarnDays = checkWarnDays
+		}
+
+		var statuses []endpointStatus
+		for _, address := range args {
+			statuses = append(statuses, checkEndpoint(address, opts, certs, time.Now()))
+		}
+
+		if checkOutput == outputJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(statuses)
+		} else {
+			printEndpointStatus(os.Stdout, statuses)
+		}
+
+		for _, status := range statuses {
+			if status.Status != statusOK {
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+// checkEndpoint fetches the certificate served at address and compares it with the managed one
+func checkEndpoint(address string, opts checkOptions, certs []CertificateConfig, now time.Time) endpointStatus {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, "443"
+	}
+	address = net.JoinHostPort(host, port)
+	serverName := opts.ServerName
+	if serverName == "" && net.ParseIP(host) == nil {
+		serverName = host
+	}
+	starttls := opts.StartTLS
+	if starttls == "" {
+		starttls = defaultStartTLS(port)
+	}
+
+	status := endpointStatus{Address: address, ServerName: serverName}
+
+	chain, err := fetchServedChain(address, serverName, starttls, opts.Timeout)
+	if err != nil {
+		status.Status, status.Error = statusError, err.Error()
+		return status
+	}
+
+	leaf := chain[0]
+	status.DNSNames = leaf.DNSNames
+	status.NotAfter = leaf.NotAfter
+	status.DaysRemaining = int(leaf.NotAfter.Sub(now).Hours() / 24)
+	status.Serial = fmt.Sprintf("%x", leaf.SerialNumber)
+	for _, cert := range chain {
+		status.Chain = append(status.Chain, chainEntry{Subject: cert.Subject.String(), Issuer: cert.Issuer.String(), NotAfter: cert.NotAfter})
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates, CurrentTime: now})
+	status.Trusted = err == nil
+	if err != nil {
+		status.TrustError = err.Error()
+	}
+
+	matches := true
+	if cert, ok := managedCertificate(certs, opts.CertName, serverName); ok {
+		status.Certificate = cert.Name
+		matches, err = servesManagedCertificate(cert, leaf)
+		if err != nil {
+			status.Status, status.Error = statusError, err.Error()
+			return status
+		}
+	} else if opts.CertName != "" {
+		status.Status, status.Error = statusError, fmt.Sprintf("certificate %s is not managed", opts.CertName)
+		return status
+	}
+
+	switch {
+	case !leaf.NotAfter.After(now):
+		status.Status = statusExpired
+	case !matches:
+		status.Status = statusMismatch
+	case leaf.NotAfter.Sub(now) <= warnBefore(leaf, opts.WarnDays):
+		status.Status = statusWarning
+	default:
+		status.Status = statusOK
+	}
+	return status
+}
+
+// defaultStartTLS returns the STARTTLS protocol usually spoken on port
+func defaultStartTLS(port string) string {
+	switch port {
+	case "25", "587":
+		return starttlsSMTP
+	case "143":
+		return starttlsIMAP
+	}
+	return starttlsNone
+}
+
+// managedCertificate returns the certificate named certName or the first one
+// whose domains cover serverName
+func managedCertificate(certs []CertificateConfig, certName, serverName string) (CertificateConfig, bool) {
+	for _, cert := range certs {
+		if certName != "" {
+			if cert.Name == certName {
+				return cert, true
+			}
+			continue
+		}
+		for _, domain := range cert.Domains {
+			if matchesDomain(domain, serverName) {
+				return cert, true
+			}
+		}
+	}
+	return CertificateConfig{}, false
+}
+
+// matchesDomain reports whether the certificate name domain, which may be a wildcard, covers name
+func matchesDomain(domain, name string) bool {
+	domain, name = strings.ToLower(domain), strings.ToLower(strings.TrimSuffix(name, "."))
+	if suffix, ok := strings.CutPrefix(domain, "*"); ok {
+		label, rest, found := strings.Cut(name, ".")
+		return found && label != "" && "."+rest == suffix
+	}
+	return domain == name
+}
+
+// servesManagedCertificate reports whether leaf is one of the installed variants of cert
+func servesManagedCertificate(cert CertificateConfig, leaf *x509.Certificate) (bool, error) {
+	for _, variant := range cert.variants() {
+		installed, err := readInstalledCertificate(filepath.Join(cert.Path, variantFileName(cert.certFile(), variant.Suffix)))
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(installed.Raw, leaf.Raw) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fetchServedChain performs a TLS handshake with address, after upgrading the
+// connection with STARTTLS if requested, and returns the served certificates
+func fetchServedChain(address, serverName, starttls string, timeout time.Duration) ([]*x509.Certificate, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	switch starttls {
+	case starttlsSMTP:
+		err = startTLSSMTP(conn)
+	case starttlsIMAP:
+		err = startTLSIMAP(conn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("STARTTLS: %v", err)
+	}
+
+	// The chain is verified separately so untrusted certificates can still be shown
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %v", err)
+	}
+
+	chain := tlsConn.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate served")
+	}
+	return chain, nil
+}
+
+// startTLSSMTP upgrades an SMTP connection (RFC 3207)
+func startTLSSMTP(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	readReply := func(code string) error {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(line, code) {
+				return fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+			}
+			// The last line of a reply has a space after the code
+			if len(line) < 4 || line[3] != '-' {
+				return nil
+			}
+		}
+	}
+
+	if err := readReply("220"); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, "EHLO nas-manager\r\n"); err != nil {
+		return err
+	}
+	if err := readReply("250"); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, "STARTTLS\r\n"); err != nil {
+		return err
+	}
+	return readReply("220")
+}
+
+// startTLSIMAP upgrades an IMAP connection (RFC 3501)
+func startTLSIMAP(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+
+	if _, err := io.WriteString(conn, "a1 STARTTLS\r\n"); err != nil {
+		return err
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "a1 ") {
+			if !strings.HasPrefix(line, "a1 OK") {
+				return fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+			}
+			return nil
+		}
+	}
+}
+
+// printEndpointStatus writes the details of every endpoint
+func printEndpointStatus(w io.Writer, statuses []endpointStatus) {
+	for i, status := range statuses {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+		fmt.Fprintf(tw, "%s\n", status.Address)
+		fmt.Fprintf(tw, "  Status:\t%s\n", status.Status)
+		if status.ServerName != "" {
+			fmt.Fprintf(tw, "  Server name:\t%s\n", status.ServerName)
+		}
+		if status.Certificate != "" {
+			fmt.Fprintf(tw, "  Certificate:\t%s\n", status.Certificate)
+		}
+		if status.Error != "" {
+			fmt.Fprintf(tw, "  Error:\t%s\n", status.Error)
+		}
+		if len(status.Chain) > 0 {
+			fmt.Fprintf(tw, "  SANs:\t%s\n", strings.Join(status.DNSNames, ", "))
+			fmt.Fprintf(tw, "  Not after:\t%s\n", status.NotAfter.UTC().Format(time.RFC3339))
+			fmt.Fprintf(tw, "  Days remaining:\t%d\n", status.DaysRemaining)
+			fmt.Fprintf(tw, "  Serial:\t%s\n", status.Serial)
+			if status.Trusted {
+				fmt.Fprintf(tw, "  Trusted:\tyes\n")
+			} else {
+				fmt.Fprintf(tw, "  Trusted:\tno (%s)\n", status.TrustError)
+			}
+			for i, cert := range status.Chain {
+				fmt.Fprintf(tw, "  Chain %d:\t%s (issuer %s, until %s)\n", i, cert.Subject, cert.Issuer, cert.NotAfter.UTC().Format("2006-01-02"))
+			}
+		}
+		tw.Flush()
+	}
+}
+
+func init() {
+	checkCmd.Flags().StringVarP(&checkOutput, "output", "o", outputTable, "Output format: table or json")
+	checkCmd.Flags().IntVar(&checkWarnDays, "warn-days", 0, fmt.Sprintf("Exit non-zero when the served certificate expires within this many days (default ACME_WARN_DAYS or %d)", defaultWarnDays))
+	checkCmd.Flags().StringVar(&checkServerName, "servername", "", "Server name sent with SNI (default the host)")
+	checkCmd.Flags().StringVar(&checkStartTLS, "starttls", "", "STARTTLS protocol: smtp, imap or none (default by port)")
+	checkCmd.Flags().StringVar(&checkCertName, "cert", "", "Compare with this managed certificate (default the one matching the server name)")
+	checkCmd.Flags().DurationVar(&checkTimeout, "timeout", 10*time.Second, "Connection timeout")
+	acmeCmd.AddCommand(checkCmd)
+}
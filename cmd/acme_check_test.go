@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTLSConfig returns a server configuration for a new test chain of domain
+func testTLSConfig(t *testing.T, domain string) (*tls.Config, []byte) {
+	t.Helper()
+
+	key, leaf, issuer := newTestChain(t, domain)
+	pair, err := tls.X509KeyPair(append(append([]byte{}, leaf...), issuer...), key)
+	if err != nil {
+		t.Fatalf("Failed to load key pair: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{pair}}, leaf
+}
+
+// serveStartTLS accepts one connection, speaks the plain text part of the
+// protocol and then completes a TLS handshake
+func serveStartTLS(t *testing.T, config *tls.Config, protocol string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		switch protocol {
+		case starttlsSMTP:
+			io.WriteString(conn, "220 mail.example.com ESMTP\r\n")
+			reader.ReadString('\n')
+			io.WriteString(conn, "250-mail.example.com\r\n250-PIPELINING\r\n250 STARTTLS\r\n")
+			reader.ReadString('\n')
+			io.WriteString(conn, "220 Ready to start TLS\r\n")
+		case starttlsIMAP:
+			io.WriteString(conn, "* OK IMAP4rev1 ready\r\n")
+			reader.ReadString('\n')
+			io.WriteString(conn, "a1 OK Begin TLS negotiation now\r\n")
+		}
+
+		tls.Server(conn, config).Handshake()
+	}()
+	return listener.Addr().String()
+}
+
+func TestCheckEndpoint(t *testing.T) {
+	config, leaf := testTLSConfig(t, "nas.example.com")
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "nas.cer"), leaf, 0644)
+	certs := []CertificateConfig{{Name: "nas", Domains: []string{"nas.example.com"}, Path: dir}}
+	opts := checkOptions{ServerName: "nas.example.com", Timeout: 5 * time.Second, WarnDays: 14}
+
+	status := checkEndpoint(address, opts, certs, time.Now())
+	if status.Status != statusOK || status.Certificate != "nas" || len(status.Chain) != 2 || status.Trusted {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if len(status.DNSNames) != 1 || status.DNSNames[0] != "nas.example.com" {
+		t.Errorf("Unexpected SANs: %v", status.DNSNames)
+	}
+
+	if status := checkEndpoint(address, opts, certs, time.Now().Add(85*24*time.Hour)); status.Status != statusWarning {
+		t.Errorf("Expected warning, got %+v", status)
+	}
+	if status := checkEndpoint(address, opts, certs, time.Now().Add(91*24*time.Hour)); status.Status != statusExpired {
+		t.Errorf("Expected expired, got %+v", status)
+	}
+
+	_, other, _ := newTestChain(t, "nas.example.com")
+	os.WriteFile(filepath.Join(dir, "nas.cer"), other, 0644)
+	if status := checkEndpoint(address, opts, certs, time.Now()); status.Status != statusMismatch {
+		t.Errorf("Expected mismatch, got %+v", status)
+	}
+
+	// Endpoints without a managed certificate are only checked for expiry
+	opts.ServerName = "other.example.com"
+	if status := checkEndpoint(address, opts, certs, time.Now()); status.Status != statusOK || status.Certificate != "" {
+		t.Errorf("Unexpected status for unmanaged endpoint: %+v", status)
+	}
+
+	opts.CertName = "proxy"
+	if status := checkEndpoint(address, opts, certs, time.Now()); status.Status != statusError {
+		t.Errorf("Expected error for unknown certificate, got %+v", status)
+	}
+
+	server.Close()
+	if status := checkEndpoint(address, opts, certs, time.Now()); status.Status != statusError {
+		t.Errorf("Expected error for closed endpoint, got %+v", status)
+	}
+}
+
+func TestCheckEndpointStartTLS(t *testing.T) {
+	config, leaf := testTLSConfig(t, "mail.example.com")
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mail.cer"), leaf, 0644)
+	certs := []CertificateConfig{{Name: "mail", Domains: []string{"*.example.com"}, Path: dir}}
+
+	for _, protocol := range []string{starttlsSMTP, starttlsIMAP} {
+		address := serveStartTLS(t, config, protocol)
+		opts := checkOptions{ServerName: "mail.example.com", StartTLS: protocol, Timeout: 5 * time.Second, WarnDays: 14}
+		status := checkEndpoint(address, opts, certs, time.Now())
+		if status.Status != statusOK || status.Certificate != "mail" {
+			t.Errorf("%s: unexpected status %+v", protocol, status)
+		}
+	}
+
+	// A server that does not offer STARTTLS is reported
+	address := serveStartTLS(t, config, starttlsIMAP)
+	status := checkEndpoint(address, checkOptions{ServerName: "mail.example.com", StartTLS: starttlsSMTP, Timeout: 5 * time.Second}, certs, time.Now())
+	if status.Status != statusError || !strings.Contains(status.Error, "STARTTLS") {
+		t.Errorf("Expected STARTTLS error, got %+v", status)
+	}
+}
+
+func TestMatchesDomain(t *testing.T) {
+	tests := []struct {
+		domain, name string
+		expected     bool
+	}{
+		{"nas.example.com", "NAS.example.com.", true},
+		{"*.example.com", "mail.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.mail.example.com", false},
+		{"nas.example.com", "mail.example.com", false},
+	}
+	for _, tt := range tests {
+		if matchesDomain(tt.domain, tt.name) != tt.expected {
+			t.Errorf("Expected matchesDomain(%q, %q) = %v", tt.domain, tt.name, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// defaultPostDeploy returns the nginx reload command of the Synology DSM version
+// found on this system or an empty string elsewhere
+func defaultPostDeploy() string {
+	if _, err := os.Stat("/usr/syno/bin/synosystemctl"); err == nil {
+		return "/usr/syno/bin/synosystemctl reload nginx"
+	}
+	if _, err := os.Stat("/usr/syno/sbin/synoservicectl"); err == nil {
+		return "/usr/syno/sbin/synoservicectl --reload nginx"
+	}
+	return ""
+}
+
+// errCertificateInstalled marks deployment errors that occur after the files were replaced
+var errCertificateInstalled = errors.New("certificate installed")
+
+// deployCertificate verifies and installs the certificate files, deploys them to
+// the configured targets and runs the deploy hooks. The files in cert.Path are
+// always written as renewals are decided on them. When cert.Path is not writable
+// they go to a fallback directory that is recorded in cert.FallbackFile, so
+// renewals check that copy instead; the service keeps its certificate then, so
+// TLSA records, deploy targets and post-deploy hooks are skipped. The replaced files are kept as
+// a backup. A failing pre-deploy hook aborts the deployment. When verification
+// of a deploy target fails, the backup is restored.
+func deployCertificate(cert CertificateConfig, files map[string][]byte) error {
+	return installCertificate(cert, files, true)
+}
+
+func installCertificate(cert CertificateConfig, files map[string][]byte, backup bool) error {
+	if err := verifyCertificateFiles(cert, files); err != nil {
+		return fmt.Errorf("verification failed: %v", err)
+	}
+
+	certPath := cert.Path
+	usingFallback := false
+
+	// Try to create directory and test write permissions
+	if err := os.MkdirAll(certPath, 0755); err != nil {
+		usingFallback = true
+	} else {
+		// Test write permissions by creating a temporary file
+		testFile := filepath.Join(certPath, ".write_test")
+		if err := os.WriteFile(testFile, []byte("test"), 0644); err != nil {
+			usingFallback = true
+		} else {
+			os.Remove(testFile)
+		}
+		// Files are staged next to the directory
+		if absPath, err := filepath.Abs(certPath); err != nil {
+			usingFallback = true
+		} else if staging, err := newStagingDir(cert, absPath); err != nil {
+			usingFallback = true
+		} else {
+			os.Remove(staging)
+		}
+	}
+
+	if usingFallback {
+		dateStr := time.Now().Format("2006-01-02")
+		domainSafe := strings.ReplaceAll(cert.Name, ".", "_")
+		certPath, _ = filepath.Abs(fmt.Sprintf("./certs/%s-%s", domainSafe, dateStr))
+		fmt.Printf("Permission denied for %s, using fallback directory: %s\n", cert.Path, certPath)
+		if err := os.MkdirAll(certPath, 0755); err != nil {
+			return fmt.Errorf("failed to create fallback directory: %v", err)
+		}
+	}
+
+	env := deployEnv(cert, certPath, files)
+
+	if err := runDeployHooks(cert, cert.PreDeploy, "pre-deploy", env); err != nil {
+		return fmt.Errorf("deployment aborted: %v", err)
+	}
+
+	// New TLSA records are published before the certificate is replaced. A certificate
+	// in the fallback directory is not served, its records stay as they are.
+	var tlsa []tlsaRecord
+	if len(cert.TLSA) > 0 && !usingFallback {
+		tlsaRecords, wait, err := publishTLSA(cert, files)
+		if err != nil {
+			return fmt.Errorf("deployment aborted: TLSA: %v", err)
+		}
+		tlsa = tlsaRecords
+		if wait > 0 {
+			fmt.Printf("[%s] Waiting %s for the new TLSA records to replace cached ones\n", cert.Name, wait)
+			time.Sleep(wait)
+		}
+	}
+
+	backupPath, err := installFiles(cert, certPath, files, backup)
+	if err != nil {
+		return err
+	}
+
+	if err := recordFallback(cert, certPath, usingFallback); err != nil {
+		fmt.Printf("[%s] Failed to record the fallback directory: %v\n", cert.Name, err)
+	}
+	if usingFallback {
+		fmt.Printf("Certificates saved to fallback directory: %s\n", certPath)
+		fmt.Printf("Please manually copy certificates to: %s\n", cert.Path)
+		fmt.Printf("Run: sudo cp %s/* %s/\n", certPath, cert.Path)
+		// The service keeps the old certificate, so nothing is deployed, reloaded or verified
+		return nil
+	}
+
+	// Once the files are installed, failures of the following steps are collected
+	// so the service is still reloaded and verified
+	var errs []string
+	for _, target := range cert.Deploy {
+		if target == deploySynology {
+			if err := deploySynologyCertificate(cert, files); err != nil {
+				fmt.Printf("[%s] %v\n", cert.Name, err)
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if len(cert.TLSA) > 0 {
+		if err := retireTLSA(cert, tlsa, time.Now()); err != nil {
+			fmt.Printf("[%s] Failed to retire the replaced TLSA records: %v\n", cert.Name, err)
+			errs = append(errs, fmt.Sprintf("TLSA: %v", err))
+		}
+	}
+
+	// A failed reload may leave the service down, so verification still decides on a rollback
+	if err := runDeployHooks(cert, cert.PostDeploy, "post-deploy", env); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	// Rollbacks are not verified again, they restore the last known good state
+	if backup && len(cert.Verify) > 0 {
+		if err := verifyDeployment(cert, files); err != nil {
+			err = rollbackDeployment(cert, backupPath, err)
+			if len(errs) > 0 {
+				return fmt.Errorf("%v; %s", err, strings.Join(errs, "; "))
+			}
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w but %s", errCertificateInstalled, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// recordFallback stores the fallback directory the certificate was written to,
+// or removes the record once it was written to cert.Path again
+func recordFallback(cert CertificateConfig, certPath string, usingFallback bool) error {
+	if cert.FallbackFile == "" {
+		return nil
+	}
+	if !usingFallback {
+		if err := os.Remove(cert.FallbackFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cert.FallbackFile), 0700); err != nil {
+		return err
+	}
+	return writeFileSync(cert.FallbackFile, []byte(certPath+"\n"), 0600)
+}
+
+// installedDir returns the directory holding the installed certificate: cert.Path,
+// or the fallback directory when the last deployment could not write to cert.Path
+func (c CertificateConfig) installedDir() string {
+	if c.FallbackFile != "" {
+		if data, err := os.ReadFile(c.FallbackFile); err == nil {
+			if dir := strings.TrimSpace(string(data)); dir != "" {
+				return dir
+			}
+		}
+	}
+	return c.Path
+}
+
+// deployEnv returns the environment passed to deploy hooks
+func deployEnv(cert CertificateConfig, certPath string, files map[string][]byte) map[string]string {
+	env := map[string]string{
+		"CERT_NAME":        cert.Name,
+		"CERT_DOMAINS":     strings.Join(cert.Domains, ","),
+		"CERT_PATH":        certPath,
+		"CERT_TARGET_PATH": cert.Path,
+	}
+	for key, format := range map[string]string{
+		"CERT_KEY_FILE":       outputKey,
+		"CERT_FULLCHAIN_FILE": outputFullchain,
+		"CERT_CHAIN_FILE":     outputChain,
+		"CERT_COMBINED_FILE":  outputCombined,
+		"CERT_PKCS12_FILE":    outputPKCS12,
+	} {
+		if file := cert.outputFile(format); file != "" {
+			env[key] = filepath.Join(certPath, file)
+		}
+	}
+	// The default outputs write no leaf-only file, <name>.cer holds the full chain
+	env["CERT_FILE"] = filepath.Join(certPath, cert.certFile())
+
+	if leaf, err := certcrypto.ParsePEMCertificate(files[cert.certFile()]); err == nil {
+		env["CERT_NOT_BEFORE"] = leaf.NotBefore.UTC().Format(time.RFC3339)
+		env["CERT_NOT_AFTER"] = leaf.NotAfter.UTC().Format(time.RFC3339)
+		env["CERT_SERIAL"] = fmt.Sprintf("%x", leaf.SerialNumber)
+	}
+	return env
+}
+
+// runDeployHooks runs the hooks configured in value for cert
+func runDeployHooks(cert CertificateConfig, value, phase string, env map[string]string) error {
+	hooks, err := parseHooks(value)
+	if err != nil {
+		return fmt.Errorf("%s hook: %v", phase, err)
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	phaseEnv := map[string]string{"CERT_HOOK_PHASE": phase}
+	for key, value := range env {
+		phaseEnv[key] = value
+	}
+
+	err = runHooks(hooks, phaseEnv, cert.HookTimeout, func(msg string) {
+		fmt.Printf("[%s] %s\n", cert.Name, msg)
+	})
+	if err != nil {
+		return fmt.Errorf("%s %v", phase, err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeployCertificateHooks(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "hook.out")
+
+	cert := CertificateConfig{
+		Name:        "nas",
+		Domains:     []string{"nas.example.com", "www.example.com"},
+		Path:        dir,
+		PreDeploy:   `sh -c 'test ! -e "$CERT_FILE" && echo "$CERT_HOOK_PHASE" >> ` + out + `'`,
+		PostDeploy:  `sh -c 'test -e "$CERT_FILE" && echo "$CERT_HOOK_PHASE $CERT_DOMAINS $CERT_NOT_AFTER" >> ` + out + `'`,
+		HookTimeout: 10 * time.Second,
+	}
+	files := map[string][]byte{"nas.cer": newTestCertificate(t, key, cert.Domains, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))}
+
+	if err := deployCertificate(cert, files); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, _ := os.ReadFile(out)
+	expected := "pre-deploy\npost-deploy nas.example.com,www.example.com 2030-01-02T03:04:05Z\n"
+	if string(data) != expected {
+		t.Errorf("Expected hook output %q, got %q", expected, string(data))
+	}
+}
+
+func TestDeployCertificateHookFailure(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dir := t.TempDir()
+	cert := CertificateConfig{Name: "nas", Domains: []string{"nas.example.com"}, Path: dir, PreDeploy: "false", HookTimeout: 10 * time.Second}
+	files := map[string][]byte{"nas.cer": newTestCertificate(t, key, cert.Domains, time.Now().Add(time.Hour))}
+
+	err := deployCertificate(cert, files)
+	if err == nil || !strings.Contains(err.Error(), "pre-deploy") {
+		t.Errorf("Expected pre-deploy error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nas.cer")); !os.IsNotExist(err) {
+		t.Error("Expected failed pre-deploy hook to abort installation")
+	}
+
+	cert.PreDeploy = ""
+	cert.PostDeploy = "sleep 5"
+	cert.HookTimeout = 100 * time.Millisecond
+	err = deployCertificate(cert, files)
+	if err == nil || !strings.Contains(err.Error(), "post-deploy") {
+		t.Errorf("Expected post-deploy timeout error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nas.cer")); err != nil {
+		t.Errorf("Expected certificate to be installed before post-deploy hook: %v", err)
+	}
+}
+
+func TestDeployFallbackSkipsService(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("CLOUDFLARE_DNS_API_TOKEN", "")
+	t.Setenv("CF_API_TOKEN", "")
+	blocked := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(blocked, nil, 0644)
+	out := filepath.Join(t.TempDir(), "hook.out")
+
+	// Without an API token TLSA records cannot be touched, so the deployment
+	// only succeeds when they are skipped
+	cert := CertificateConfig{
+		Name:          "nas",
+		Domains:       []string{"nas.example.com"},
+		Path:          filepath.Join(blocked, "certs"),
+		Deploy:        []string{deployFiles},
+		PostDeploy:    `sh -c 'echo reloaded >> ` + out + `'`,
+		HookTimeout:   10 * time.Second,
+		TLSA:          []string{"_25._tcp.nas.example.com"},
+		TLSAUsages:    []int{3},
+		TLSAStateFile: filepath.Join(t.TempDir(), "tlsa", "nas.json"),
+	}
+	if err := deployCertificate(cert, testFiles(t, "nas")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("Expected no reload for a certificate in the fallback directory")
+	}
+}
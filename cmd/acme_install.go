@@ -0,0 +1,339 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// backupTimeFormat names backup directories so they sort chronologically
+const backupTimeFormat = "20060102T150405Z"
+
+// verifyCertificateFiles checks for every key type variant that the private key
+// belongs to the certificate and that each chain certificate signed the previous one
+func verifyCertificateFiles(cert CertificateConfig, files map[string][]byte) error {
+	for _, variant := range cert.variants() {
+		if err := verifyVariantFiles(cert, files, variant.Suffix); err != nil {
+			if variant.Suffix != "" {
+				return fmt.Errorf("%s: %v", variant.Suffix, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyVariantFiles(cert CertificateConfig, files map[string][]byte, suffix string) error {
+	file := func(format string) []byte {
+		if name := cert.outputFile(format); name != "" {
+			return files[variantFileName(name, suffix)]
+		}
+		return nil
+	}
+
+	certs, err := variantChain(cert, files, suffix)
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %v", err)
+	}
+	if certs == nil {
+		return nil
+	}
+
+	for i := 1; i < len(certs); i++ {
+		if err := certs[i-1].CheckSignatureFrom(certs[i]); err != nil {
+			return fmt.Errorf("chain does not build: %s is not signed by %s: %v", certs[i-1].Subject, certs[i].Subject, err)
+		}
+	}
+
+	keyData := file(outputKey)
+	if keyData == nil {
+		keyData = file(outputCombined)
+	}
+	if keyData == nil {
+		return nil
+	}
+	return keyMatches(keyData, certs[0])
+}
+
+// variantChain parses the leaf and chain of a variant from the fullchain output
+// or the cert and chain outputs. It returns nil when neither is written.
+func variantChain(cert CertificateConfig, files map[string][]byte, suffix string) ([]*x509.Certificate, error) {
+	file := func(format string) []byte {
+		if name := cert.outputFile(format); name != "" {
+			return files[variantFileName(name, suffix)]
+		}
+		return nil
+	}
+
+	if data := file(outputFullchain); data != nil {
+		return certcrypto.ParsePEMBundle(data)
+	}
+	if data := file(outputCert); data != nil {
+		return certcrypto.ParsePEMBundle(append(append([]byte{}, data...), file(outputChain)...))
+	}
+	return nil, nil
+}
+
+// keyMatches checks that the PEM encoded private key belongs to cert
+func keyMatches(keyPEM []byte, cert *x509.Certificate) error {
+	key, err := certcrypto.ParsePEMPrivateKey(keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported private key")
+	}
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(cert.PublicKey) {
+		return errors.New("private key does not match certificate")
+	}
+	return nil
+}
+
+// installManifest lists the files of a staging directory once all are written
+const installManifest = ".install"
+
+// stagingPrefix names the staging directories of cert for dir. They are created
+// next to dir so that private keys are never staged inside the served directory.
+func stagingPrefix(cert CertificateConfig, dir string) string {
+	return "." + filepath.Base(dir) + "." + cert.Name + ".staging-"
+}
+
+// newStagingDir creates a private staging directory next to dir. It is on the
+// same file system, so its files can be renamed into dir.
+func newStagingDir(cert CertificateConfig, dir string) (string, error) {
+	return os.MkdirTemp(filepath.Dir(dir), stagingPrefix(cert, dir))
+}
+
+// installFiles stages files next to dir and moves them into dir. The files they
+// replace are copied to a new backup first unless backup is false; its path is
+// returned. When moving fails halfway the previous files are restored. When the
+// process dies while moving, the next install or renew run finishes the switch
+// from the staging directory, see completeInstall.
+func installFiles(cert CertificateConfig, dir string, files map[string][]byte, backup bool) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := completeInstall(cert, dir); err != nil {
+		return "", err
+	}
+
+	staging, err := newStagingDir(cert, dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+
+	for filename, content := range files {
+		perm := os.FileMode(0644)
+		if cert.isSecretFile(filename) {
+			perm = 0600
+		}
+		if err := writeFileSync(filepath.Join(staging, filename), content, perm); err != nil {
+			return "", fmt.Errorf("failed to stage %s: %v", filename, err)
+		}
+	}
+
+	previous := map[string][]byte{}
+	for filename := range files {
+		data, err := os.ReadFile(filepath.Join(dir, filename))
+		if err == nil {
+			previous[filename] = data
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("failed to read installed %s: %v", filename, err)
+		}
+	}
+
+	backupPath := ""
+	if backup && cert.BackupDir != "" && len(previous) > 0 {
+		var err error
+		backupPath, err = writeBackup(cert, previous)
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("[%s] Previous certificate saved to %s\n", cert.Name, backupPath)
+	}
+
+	names := make([]string, 0, len(files))
+	for filename := range files {
+		names = append(names, filename)
+	}
+	sort.Strings(names)
+
+	// From here on the staging directory holds a complete set that completeInstall may finish
+	if err := writeFileSync(filepath.Join(staging, installManifest), []byte(strings.Join(names, "\n")), 0600); err != nil {
+		return "", fmt.Errorf("failed to stage the file list: %v", err)
+	}
+
+	for i, filename := range names {
+		if err := os.Rename(filepath.Join(staging, filename), filepath.Join(dir, filename)); err != nil {
+			restoreFiles(cert, dir, names[:i], previous)
+			return "", fmt.Errorf("failed to install %s: %v", filename, err)
+		}
+	}
+	return backupPath, nil
+}
+
+// completeInstall moves the remaining files of an interrupted install into dir,
+// so a crash never leaves the key of one certificate next to the chain of another.
+// Staging directories that were not completely written are removed.
+func completeInstall(cert CertificateConfig, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Dir(dir))
+	if err != nil {
+		// Nothing can have been staged where the directory cannot be listed
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+			return nil
+		}
+		return fmt.Errorf("failed to look for interrupted installs: %v", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), stagingPrefix(cert, dir)) {
+			continue
+		}
+		staging := filepath.Join(filepath.Dir(dir), entry.Name())
+		manifest, err := os.ReadFile(filepath.Join(staging, installManifest))
+		if err == nil {
+			for _, filename := range strings.Split(string(manifest), "\n") {
+				err := os.Rename(filepath.Join(staging, filename), filepath.Join(dir, filename))
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					return fmt.Errorf("failed to finish the interrupted install of %s: %v", filename, err)
+				}
+			}
+			fmt.Printf("[%s] Finished the interrupted install from %s\n", cert.Name, staging)
+		}
+		if err := os.RemoveAll(staging); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", staging, err)
+		}
+	}
+	return nil
+}
+
+// restoreFiles puts back the previous content of files that were already replaced
+func restoreFiles(cert CertificateConfig, dir string, names []string, previous map[string][]byte) {
+	for _, filename := range names {
+		path := filepath.Join(dir, filename)
+		content, ok := previous[filename]
+		if !ok {
+			os.Remove(path)
+			continue
+		}
+		perm := os.FileMode(0644)
+		if cert.isSecretFile(filename) {
+			perm = 0600
+		}
+		if err := writeFileSync(path, content, perm); err != nil {
+			fmt.Printf("[%s] Failed to restore %s: %v\n", cert.Name, path, err)
+		}
+	}
+}
+
+// writeFileSync writes a file and flushes it to disk
+func writeFileSync(path string, content []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeBackup stores files in a new timestamped backup directory and removes
+// the oldest backups beyond cert.Backups
+func writeBackup(cert CertificateConfig, files map[string][]byte) (string, error) {
+	if err := os.MkdirAll(cert.BackupDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	name := time.Now().UTC().Format(backupTimeFormat)
+	path := filepath.Join(cert.BackupDir, name)
+	for i := 1; ; i++ {
+		err := os.Mkdir(path, 0700)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", fmt.Errorf("failed to create backup: %v", err)
+		}
+		path = filepath.Join(cert.BackupDir, fmt.Sprintf("%s-%02d", name, i))
+	}
+
+	for filename, content := range files {
+		if err := writeFileSync(filepath.Join(path, filename), content, 0600); err != nil {
+			return "", fmt.Errorf("failed to write backup: %v", err)
+		}
+	}
+
+	if cert.Backups > 0 {
+		backups, err := listBackups(cert)
+		if err == nil && len(backups) > cert.Backups {
+			for _, old := range backups[:len(backups)-cert.Backups] {
+				os.RemoveAll(filepath.Join(cert.BackupDir, old))
+			}
+		}
+	}
+	return path, nil
+}
+
+// listBackups returns the backups of a certificate from oldest to newest
+func listBackups(cert CertificateConfig) ([]string, error) {
+	entries, err := os.ReadDir(cert.BackupDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// readBackup reads the files of a backup
+func readBackup(cert CertificateConfig, name string) (map[string][]byte, error) {
+	path := filepath.Join(cert.BackupDir, name)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = data
+	}
+	return files, nil
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// newTestChain returns the PEM encoded key, leaf and issuer of a certificate signed by a test CA
+func newTestChain(t *testing.T, domain string) ([]byte, []byte, []byte) {
+	t.Helper()
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	return certcrypto.PEMEncode(key), certcrypto.PEMEncode(certcrypto.DERCertificateBytes(der)), certcrypto.PEMEncode(certcrypto.DERCertificateBytes(caDER))
+}
+
+// testFiles returns the default output files of a certificate signed by a test CA
+func testFiles(t *testing.T, name string) map[string][]byte {
+	key, leaf, issuer := newTestChain(t, name+".example.com")
+	fullchain := append(append([]byte{}, leaf...), issuer...)
+	return map[string][]byte{
+		name + ".key":   key,
+		name + ".cer":   fullchain,
+		"ca.cer":        issuer,
+		"fullchain.pem": fullchain,
+		"privkey.pem":   key,
+		"fullchain.cer": fullchain,
+	}
+}
+
+func TestVerifyCertificateFiles(t *testing.T) {
+	cert := CertificateConfig{Name: "nas"}
+	files := testFiles(t, "nas")
+	if err := verifyCertificateFiles(cert, files); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	other := testFiles(t, "nas")
+	mismatch := map[string][]byte{"nas.key": other["nas.key"], "nas.cer": files["nas.cer"], "fullchain.pem": files["fullchain.pem"]}
+	if err := verifyCertificateFiles(cert, mismatch); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Expected key mismatch error, got %v", err)
+	}
+
+	leaf, _ := splitPEMChain(files["nas.cer"])
+	broken := map[string][]byte{"nas.key": files["nas.key"], "nas.cer": append(append([]byte{}, leaf...), other["ca.cer"]...)}
+	if err := verifyCertificateFiles(cert, broken); err == nil || !strings.Contains(err.Error(), "chain does not build") {
+		t.Errorf("Expected chain error, got %v", err)
+	}
+}
+
+func TestInstallAndRollback(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "hook.out")
+	cert := CertificateConfig{
+		Name:        "nas",
+		Domains:     []string{"nas.example.com"},
+		Path:        dir,
+		BackupDir:   filepath.Join(t.TempDir(), "backups"),
+		Backups:     2,
+		PostDeploy:  `sh -c 'echo "$CERT_SERIAL" >> ` + out + `'`,
+		HookTimeout: 10 * time.Second,
+	}
+
+	var versions []map[string][]byte
+	for i := 0; i < 3; i++ {
+		files := testFiles(t, "nas")
+		versions = append(versions, files)
+		if err := deployCertificate(cert, files); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	backups, _ := listBackups(cert)
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %v", backups)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != len(versions[2]) {
+		t.Errorf("Expected staging directory to be removed, got %d entries", len(entries))
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "nas.key")); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected key permissions 0600, got %o", info.Mode().Perm())
+	}
+
+	if _, err := rollbackCertificate(cert); err != nil {
+		t.Fatalf("Unexpected rollback error: %v", err)
+	}
+	for name, content := range versions[1] {
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != string(content) {
+			t.Errorf("Expected %s of the previous certificate", name)
+		}
+	}
+	if backups, _ := listBackups(cert); len(backups) != 1 {
+		t.Errorf("Expected restored backup to be removed, got %v", backups)
+	}
+
+	data, _ := os.ReadFile(out)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 4 || lines[3] != lines[1] {
+		t.Errorf("Expected post-deploy hook to run with the restored certificate, got %q", string(data))
+	}
+}
+
+func TestInstallFilesRestoresOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	cert := CertificateConfig{Name: "nas"}
+	os.WriteFile(filepath.Join(dir, "a.pem"), []byte("old"), 0644)
+	os.Mkdir(filepath.Join(dir, "b.pem"), 0755)
+	os.WriteFile(filepath.Join(dir, "b.pem", "keep"), []byte("x"), 0644)
+
+	_, err := installFiles(cert, dir, map[string][]byte{"a.pem": []byte("new"), "b.pem": []byte("new")}, false)
+	if err == nil {
+		t.Fatal("Expected install to fail")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.pem")); string(data) != "old" {
+		t.Errorf("Expected a.pem to be restored, got %q", string(data))
+	}
+}
+
+func TestCompleteInstall(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "certs")
+	cert := CertificateConfig{Name: "nas"}
+	os.Mkdir(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "a.pem"), []byte("new"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.pem"), []byte("old"), 0644)
+
+	// b.pem was still staged when the install was interrupted
+	staging, err := newStagingDir(cert, dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	os.WriteFile(filepath.Join(staging, "b.pem"), []byte("new"), 0644)
+	os.WriteFile(filepath.Join(staging, installManifest), []byte("a.pem\nb.pem"), 0600)
+	incomplete, _ := newStagingDir(cert, dir)
+	os.WriteFile(filepath.Join(incomplete, "a.pem"), []byte("partial"), 0644)
+
+	if err := completeInstall(cert, dir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"a.pem", "b.pem"} {
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != "new" {
+			t.Errorf("Expected the staged %s to be installed, got %q", name, string(data))
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("Expected the staging directories to be removed, got %d entries", len(entries))
+	}
+}
+
+func TestRestoreBackupFailingHook(t *testing.T) {
+	dir := t.TempDir()
+	cert := CertificateConfig{
+		Name:        "nas",
+		Domains:     []string{"nas.example.com"},
+		Path:        dir,
+		BackupDir:   filepath.Join(t.TempDir(), "backups"),
+		Backups:     2,
+		HookTimeout: 10 * time.Second,
+	}
+	for i := 0; i < 2; i++ {
+		if err := deployCertificate(cert, testFiles(t, "nas")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	cert.PostDeploy = "false"
+	if _, err := rollbackCertificate(cert); err == nil {
+		t.Fatal("Expected the failing post-deploy hook to be reported")
+	}
+	if backups, _ := listBackups(cert); len(backups) != 0 {
+		t.Errorf("Expected the installed backup to be removed, got %v", backups)
+	}
+}
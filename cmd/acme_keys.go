@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// applyKeySource checks the CSR and key file of a certificate. The domains are
+// taken from the CSR when none are configured and the key type follows the
+// supplied key, as it cannot be chosen anymore.
+func applyKeySource(cert *CertificateConfig) error {
+	if cert.CSR == "" && cert.KeyFile == "" {
+		return nil
+	}
+	if cert.DualKeyType != "" {
+		return fmt.Errorf("certificate %s: dual issuance cannot be combined with a CSR or key file", cert.Name)
+	}
+
+	var key crypto.PrivateKey
+	if cert.KeyFile != "" {
+		var err error
+		if key, err = readPrivateKey(cert.KeyFile); err != nil {
+			return fmt.Errorf("certificate %s: %v", cert.Name, err)
+		}
+		cert.KeyType = publicKeyType(key.(crypto.Signer).Public())
+	}
+
+	if cert.CSR != "" {
+		csr, err := readCSR(cert.CSR)
+		if err != nil {
+			return fmt.Errorf("certificate %s: %v", cert.Name, err)
+		}
+		if len(cert.Domains) == 0 {
+			cert.Domains = csrDomains(csr)
+		} else if !sameDomains(cert.Domains, csrDomains(csr)) {
+			return fmt.Errorf("certificate %s: domains do not match the CSR (%v)", cert.Name, csrDomains(csr))
+		}
+		if key != nil {
+			public, ok := key.(crypto.Signer).Public().(interface{ Equal(crypto.PublicKey) bool })
+			if !ok || !public.Equal(csr.PublicKey) {
+				return fmt.Errorf("certificate %s: key file does not match the CSR", cert.Name)
+			}
+		}
+		cert.KeyType = publicKeyType(csr.PublicKey)
+	}
+	return nil
+}
+
+// hasKey reports whether the private key of issued certificates is known
+func (c CertificateConfig) hasKey() bool {
+	return c.CSR == "" || c.KeyFile != ""
+}
+
+// certificateKey returns the private key to request the certificate variant
+// with or nil to have a new one generated. A configured key file is always
+// used, with ReuseKey the installed key is kept while its key type matches.
+func certificateKey(cert CertificateConfig, variant certificateVariant) (crypto.PrivateKey, error) {
+	if cert.KeyFile != "" {
+		return readPrivateKey(cert.KeyFile)
+	}
+	if !cert.ReuseKey {
+		return nil, nil
+	}
+
+	name := cert.outputFile(outputKey)
+	if name == "" {
+		name = cert.outputFile(outputCombined)
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	key, err := readPrivateKey(filepath.Join(cert.Path, variantFileName(name, variant.Suffix)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if installed := publicKeyType(key.(crypto.Signer).Public()); installed != variant.KeyType {
+		fmt.Printf("[%s] Installed key is %s, generating a new %s key\n", cert.Name, keyTypeName(installed), keyTypeName(variant.KeyType))
+		return nil, nil
+	}
+	return key, nil
+}
+
+// readPrivateKey reads a PEM encoded private key
+func readPrivateKey(path string) (crypto.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := certcrypto.ParsePEMPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if _, ok := key.(crypto.Signer); !ok {
+		return nil, fmt.Errorf("unsupported private key in %s", path)
+	}
+	return key, nil
+}
+
+// readCSR reads a PEM or DER encoded certificate signing request
+func readCSR(path string) (*x509.CertificateRequest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR %s: %v", path, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature in %s: %v", path, err)
+	}
+	return csr, nil
+}
+
+// csrDomains returns the names a CSR requests, including its common name
+func csrDomains(csr *x509.CertificateRequest) []string {
+	domains := csr.DNSNames
+	if cn := csr.Subject.CommonName; cn != "" {
+		found := false
+		for _, domain := range domains {
+			if domain == cn {
+				found = true
+				break
+			}
+		}
+		if !found {
+			domains = append([]string{cn}, domains...)
+		}
+	}
+	return domains
+}
+
+// publicKeyType returns the key type of a public key
+func publicKeyType(key crypto.PublicKey) certcrypto.KeyType {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return certcrypto.KeyType(fmt.Sprintf("P%d", k.Curve.Params().BitSize))
+	case *rsa.PublicKey:
+		return certcrypto.KeyType(fmt.Sprintf("%d", k.N.BitLen()))
+	}
+	return certcrypto.KeyType(fmt.Sprintf("%T", key))
+}
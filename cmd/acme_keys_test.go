@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// writeTestCSR writes a PEM encoded CSR for domains signed by key
+func writeTestCSR(t *testing.T, key *ecdsa.PrivateKey, domains []string) string {
+	t.Helper()
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains[1:],
+	}, key)
+	if err != nil {
+		t.Fatalf("Failed to create CSR: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "request.csr")
+	os.WriteFile(path, certcrypto.PEMEncode(&x509.CertificateRequest{Raw: der}), 0644)
+	return path
+}
+
+func TestApplyKeySourceCSR(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	csrPath := writeTestCSR(t, key, []string{"app.example.com", "api.example.com"})
+
+	cert := CertificateConfig{Name: "app", CSR: csrPath, KeyType: certcrypto.EC256}
+	if err := applyKeySource(&cert); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !sameDomains(cert.Domains, []string{"app.example.com", "api.example.com"}) || cert.KeyType != certcrypto.EC384 {
+		t.Errorf("Expected domains and key type from the CSR, got %v %s", cert.Domains, cert.KeyType)
+	}
+
+	if err := setOutputs(&cert, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cert.outputFile(outputKey) != "" || cert.certFile() != "app.cer" {
+		t.Errorf("Expected certificate outputs without key, got %+v", cert.Outputs)
+	}
+	if err := setOutputs(&cert, []string{"cert", "pkcs12"}); err == nil {
+		t.Error("Expected error for PKCS#12 output without key")
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "app.key")
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	os.WriteFile(keyFile, certcrypto.PEMEncode(other), 0600)
+	mismatch := CertificateConfig{Name: "app", CSR: csrPath, KeyFile: keyFile}
+	if err := applyKeySource(&mismatch); err == nil {
+		t.Error("Expected error for key file not matching the CSR")
+	}
+
+	wrong := CertificateConfig{Name: "app", CSR: csrPath, Domains: []string{"other.example.com"}}
+	if err := applyKeySource(&wrong); err == nil {
+		t.Error("Expected error for domains not matching the CSR")
+	}
+}
+
+func TestCertificateKeyReuse(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	os.WriteFile(filepath.Join(dir, "nas.key"), certcrypto.PEMEncode(key), 0600)
+
+	cert := CertificateConfig{Name: "nas", Path: dir, KeyType: certcrypto.EC256}
+	if reused, err := certificateKey(cert, certificateVariant{KeyType: certcrypto.EC256}); err != nil || reused != nil {
+		t.Errorf("Expected new key without ReuseKey, got %v (%v)", reused, err)
+	}
+
+	cert.ReuseKey = true
+	reused, err := certificateKey(cert, certificateVariant{KeyType: certcrypto.EC256})
+	if err != nil || reused == nil || !key.Equal(reused) {
+		t.Errorf("Expected installed key to be reused (%v)", err)
+	}
+
+	if reused, _ := certificateKey(cert, certificateVariant{KeyType: certcrypto.RSA2048}); reused != nil {
+		t.Error("Expected new key after key type change")
+	}
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyFile := filepath.Join(t.TempDir(), "pinned.key")
+	os.WriteFile(keyFile, certcrypto.PEMEncode(rsaKey), 0600)
+	cert = CertificateConfig{Name: "nas", Path: t.TempDir(), KeyFile: keyFile}
+	if err := applyKeySource(&cert); err != nil || cert.KeyType != certcrypto.RSA2048 {
+		t.Errorf("Expected key type from key file, got %s (%v)", cert.KeyType, err)
+	}
+	if pinned, _ := certificateKey(cert, certificateVariant{KeyType: cert.KeyType}); pinned == nil || !rsaKey.Equal(pinned) {
+		t.Error("Expected key file to be used")
+	}
+}
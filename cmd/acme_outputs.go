@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Output formats of certificate files
+const (
+	outputKey       = "key"
+	outputCert      = "cert"
+	outputChain     = "chain"
+	outputFullchain = "fullchain"
+	outputCombined  = "combined"
+	outputDER       = "der"
+	outputPKCS12    = "pkcs12"
+)
+
+// defaultOutputs returns the files written when a certificate lists no outputs.
+// <name>.cer holds the full chain as in earlier versions, services point at it.
+func defaultOutputs(name string) []string {
+	return []string{"key", "fullchain:" + name + ".cer", "chain", "fullchain", "key:privkey.pem", "fullchain:fullchain.cer"}
+}
+
+// certificateOutput is a file written for a certificate
+type certificateOutput struct {
+	Format string
+	File   string
+}
+
+// parseOutputs parses a comma separated list of "format[:file]" entries.
+// Without a file name the default name of the format is used.
+func parseOutputs(name string, values []string) ([]certificateOutput, error) {
+	var outputs []certificateOutput
+	seen := map[string]bool{}
+	for _, value := range values {
+		format, file, _ := strings.Cut(value, ":")
+		format = strings.ToLower(strings.TrimSpace(format))
+		file = strings.TrimSpace(file)
+
+		if file == "" {
+			var err error
+			if file, err = defaultOutputFile(name, format); err != nil {
+				return nil, err
+			}
+		}
+		if strings.ContainsAny(file, `/\`) {
+			return nil, fmt.Errorf("output file %q must not contain a path", file)
+		}
+		if seen[file] {
+			return nil, fmt.Errorf("output file %q is used twice", file)
+		}
+		seen[file] = true
+
+		outputs = append(outputs, certificateOutput{Format: format, File: file})
+	}
+	return outputs, nil
+}
+
+// defaultOutputFile returns the file name used for format when none is configured
+func defaultOutputFile(name, format string) (string, error) {
+	switch format {
+	case outputKey:
+		return name + ".key", nil
+	case outputCert:
+		return name + ".cer", nil
+	case outputChain:
+		return "ca.cer", nil
+	case outputFullchain:
+		return "fullchain.pem", nil
+	case outputCombined:
+		return name + ".combined.pem", nil
+	case outputDER:
+		return name + ".der", nil
+	case outputPKCS12:
+		return name + ".pfx", nil
+	}
+	return "", fmt.Errorf("unknown output format %q (use key, cert, chain, fullchain, combined, der or pkcs12)", format)
+}
+
+// outputs returns the configured outputs or the default files when none are set
+func (c CertificateConfig) outputs() []certificateOutput {
+	if len(c.Outputs) > 0 {
+		return c.Outputs
+	}
+	outputs, _ := parseOutputs(c.Name, defaultOutputs(c.Name))
+	return outputs
+}
+
+// outputFile returns the file name of the first output with the given format
+func (c CertificateConfig) outputFile(format string) string {
+	for _, output := range c.outputs() {
+		if output.Format == format {
+			return output.File
+		}
+	}
+	return ""
+}
+
+// certFile returns the output file holding the leaf certificate in PEM format
+func (c CertificateConfig) certFile() string {
+	if file := c.outputFile(outputCert); file != "" {
+		return file
+	}
+	return c.outputFile(outputFullchain)
+}
+
+// isSecretFile reports whether filename holds the private key of any variant
+func (c CertificateConfig) isSecretFile(filename string) bool {
+	for _, output := range c.outputs() {
+		if output.Format != outputKey && output.Format != outputCombined && output.Format != outputPKCS12 {
+			continue
+		}
+		for _, variant := range c.variants() {
+			if variantFileName(output.File, variant.Suffix) == filename {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateOutputs checks the outputs of a certificate
+func validateOutputs(cert CertificateConfig) error {
+	if cert.certFile() == "" {
+		return fmt.Errorf("certificate %s: outputs need a cert or fullchain file", cert.Name)
+	}
+	if !cert.hasKey() {
+		for _, format := range []string{outputKey, outputCombined, outputPKCS12} {
+			if cert.outputFile(format) != "" {
+				return fmt.Errorf("certificate %s: the %s output needs the private key, set a key file next to the CSR", cert.Name, format)
+			}
+		}
+	}
+	if cert.outputFile(outputPKCS12) != "" && cert.PKCS12Password == "" {
+		return fmt.Errorf("certificate %s: the pkcs12 output needs a password (PKCS12_PASSWORD), the bundle holds the private key", cert.Name)
+	}
+	if cert.outputFile(outputPKCS12) != "" && cert.PKCS12Encoding != "legacy" && cert.PKCS12Encoding != "modern" {
+		return fmt.Errorf("certificate %s: unsupported PKCS#12 encoding %q (use legacy or modern)", cert.Name, cert.PKCS12Encoding)
+	}
+	for _, target := range cert.Deploy {
+		if target == deploySynology && (cert.outputFile(outputKey) == "" || cert.outputFile(outputFullchain) == "") {
+			return fmt.Errorf("certificate %s: the synology deploy target needs key and fullchain outputs", cert.Name)
+		}
+	}
+	return nil
+}
+
+// certificateFiles renders the configured outputs of an issued certificate
+func certificateFiles(cert CertificateConfig, certs *certificate.Resource) (map[string][]byte, error) {
+	leaf, chain := splitPEMChain(certs.Certificate)
+	if len(leaf) == 0 {
+		return nil, errors.New("no certificate in response")
+	}
+	if len(chain) == 0 {
+		chain = certs.IssuerCertificate
+	}
+	fullchain := append(append([]byte{}, leaf...), chain...)
+
+	files := map[string][]byte{}
+	for _, output := range cert.outputs() {
+		switch output.Format {
+		case outputKey:
+			files[output.File] = certs.PrivateKey
+		case outputCert:
+			files[output.File] = leaf
+		case outputChain:
+			files[output.File] = chain
+		case outputFullchain:
+			files[output.File] = fullchain
+		case outputCombined:
+			files[output.File] = append(append([]byte{}, certs.PrivateKey...), fullchain...)
+		case outputDER:
+			block, _ := pem.Decode(leaf)
+			files[output.File] = block.Bytes
+		case outputPKCS12:
+			pfx, err := encodePKCS12(cert, certs.PrivateKey, leaf, chain)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", output.File, err)
+			}
+			files[output.File] = pfx
+		}
+	}
+	return files, nil
+}
+
+// encodePKCS12 builds a password protected PKCS#12 bundle of key, certificate and chain
+func encodePKCS12(cert CertificateConfig, keyPEM, leafPEM, chainPEM []byte) ([]byte, error) {
+	key, err := certcrypto.ParsePEMPrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	leaf, err := certcrypto.ParsePEMCertificate(leafPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+
+	var chain []*x509.Certificate
+	if len(bytes.TrimSpace(chainPEM)) > 0 {
+		if chain, err = certcrypto.ParsePEMBundle(chainPEM); err != nil {
+			return nil, fmt.Errorf("failed to parse chain: %v", err)
+		}
+	}
+
+	// Plex and older Windows versions only read the legacy encryption
+	encoder := pkcs12.LegacyDES
+	if cert.PKCS12Encoding == "modern" {
+		encoder = pkcs12.Modern
+	}
+	return encoder.Encode(key, leaf, chain, cert.PKCS12Password)
+}
+
+// splitPEMChain returns the first certificate of a PEM bundle and the remaining ones
+func splitPEMChain(data []byte) ([]byte, []byte) {
+	block, rest := pem.Decode(data)
+	if block == nil {
+		return nil, nil
+	}
+	return pem.EncodeToMemory(block), bytes.TrimLeft(rest, "\r\n")
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestParseOutputs(t *testing.T) {
+	outputs, err := parseOutputs("nas", []string{"key", "fullchain:haproxy.pem", "PKCS12"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []certificateOutput{
+		{Format: outputKey, File: "nas.key"},
+		{Format: outputFullchain, File: "haproxy.pem"},
+		{Format: outputPKCS12, File: "nas.pfx"},
+	}
+	if len(outputs) != len(expected) {
+		t.Fatalf("Expected %d outputs, got %+v", len(expected), outputs)
+	}
+	for i := range expected {
+		if outputs[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], outputs[i])
+		}
+	}
+
+	for _, values := range [][]string{{"jks"}, {"key:../nas.key"}, {"cert", "fullchain:nas.cer"}} {
+		if _, err := parseOutputs("nas", values); err == nil {
+			t.Errorf("Expected error for %v", values)
+		}
+	}
+
+	if err := validateOutputs(CertificateConfig{Name: "nas", Outputs: []certificateOutput{{Format: outputKey, File: "nas.key"}}}); err == nil {
+		t.Error("Expected error for outputs without certificate")
+	}
+
+	pkcs12Outputs := []certificateOutput{{Format: outputCert, File: "nas.cer"}, {Format: outputPKCS12, File: "nas.pfx"}}
+	if err := validateOutputs(CertificateConfig{Name: "nas", Outputs: pkcs12Outputs, PKCS12Encoding: "legacy"}); err == nil {
+		t.Error("Expected error for a pkcs12 output without password")
+	}
+	if err := validateOutputs(CertificateConfig{Name: "nas", Outputs: pkcs12Outputs, PKCS12Password: "secret", PKCS12Encoding: "legacy"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestDefaultOutputs(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyPEM := certcrypto.PEMEncode(key)
+	leaf := newTestCertificate(t, key, []string{"nas.example.com"}, time.Now().Add(90*24*time.Hour))
+	issuer := newTestCertificate(t, key, []string{"Test CA"}, time.Now().Add(365*24*time.Hour))
+	fullchain := append(append([]byte{}, leaf...), issuer...)
+
+	cert := CertificateConfig{Name: "nas"}
+	if err := setOutputs(&cert, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	files, err := certificateFiles(cert, &certificate.Resource{PrivateKey: keyPEM, Certificate: fullchain, IssuerCertificate: issuer})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The file set of earlier versions, <name>.cer keeps the full chain
+	expected := map[string][]byte{
+		"nas.key":       keyPEM,
+		"nas.cer":       fullchain,
+		"ca.cer":        issuer,
+		"fullchain.pem": fullchain,
+		"privkey.pem":   keyPEM,
+		"fullchain.cer": fullchain,
+	}
+	if len(files) != len(expected) {
+		t.Errorf("Expected %d files, got %d", len(expected), len(files))
+	}
+	for name, content := range expected {
+		if !bytes.Equal(files[name], content) {
+			t.Errorf("Unexpected content of %s", name)
+		}
+	}
+	if cert.certFile() != "nas.cer" {
+		t.Errorf("Expected renewals to check nas.cer, got %s", cert.certFile())
+	}
+}
+
+func TestCertificateFiles(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyPEM := certcrypto.PEMEncode(key)
+	leaf := newTestCertificate(t, key, []string{"nas.example.com"}, time.Now().Add(90*24*time.Hour))
+	issuer := newTestCertificate(t, key, []string{"Test CA"}, time.Now().Add(365*24*time.Hour))
+
+	outputs, _ := parseOutputs("nas", []string{"key", "cert", "chain", "fullchain", "combined", "der", "pkcs12"})
+	cert := CertificateConfig{Name: "nas", Outputs: outputs, PKCS12Password: "secret", PKCS12Encoding: "legacy"}
+	files, err := certificateFiles(cert, &certificate.Resource{
+		PrivateKey:        keyPEM,
+		Certificate:       append(append([]byte{}, leaf...), issuer...),
+		IssuerCertificate: issuer,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fullchain := append(append([]byte{}, leaf...), issuer...)
+	expected := map[string][]byte{
+		"nas.key":          keyPEM,
+		"nas.cer":          leaf,
+		"ca.cer":           issuer,
+		"fullchain.pem":    fullchain,
+		"nas.combined.pem": append(append([]byte{}, keyPEM...), fullchain...),
+	}
+	for name, content := range expected {
+		if !bytes.Equal(files[name], content) {
+			t.Errorf("Unexpected content of %s", name)
+		}
+	}
+
+	if _, err := x509.ParseCertificate(files["nas.der"]); err != nil {
+		t.Errorf("Expected DER certificate: %v", err)
+	}
+
+	pfxKey, pfxCert, pfxChain, err := pkcs12.DecodeChain(files["nas.pfx"], "secret")
+	if err != nil {
+		t.Fatalf("Failed to decode PKCS#12: %v", err)
+	}
+	if !key.Equal(pfxKey) || pfxCert.Subject.CommonName != "nas.example.com" || len(pfxChain) != 1 {
+		t.Errorf("Unexpected PKCS#12 content: %v %v", pfxCert.Subject, pfxChain)
+	}
+}
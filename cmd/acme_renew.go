@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/spf13/cobra"
+)
+
+var (
+	renewForce       bool
+	renewConcurrency int
+)
+
+var renewCmd = &cobra.Command{
+	Use:   "renew [name...]",
+	Short: "Renew certificates that are due or whose configuration changed",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, certs := requireIssueConfig(args)
+
+		concurrency := config.Concurrency
+		if cmd.Flags().Changed("concurrency") {
+			concurrency = renewConcurrency
+		}
+
+		var schedule renewalSchedule
+		if config.ARI && !renewForce {
+			schedule = newARISchedule(config)
+		}
+
+		results := renewCertificates(certs, renewForce, concurrency, schedule, func(cert CertificateConfig) error {
+			return issueCertificate(config, cert)
+		})
+
+		if printCertificateResults(os.Stdout, results) {
+			os.Exit(1)
+		}
+	},
+}
+
+// renewalSchedule returns when the installed certificate leaf should be renewed
+type renewalSchedule func(cert CertificateConfig, leaf *x509.Certificate, now time.Time) (time.Time, error)
+
+// scheduledReason starts the reasons of renewals triggered by the schedule
+const scheduledReason = "renewal time "
+
+// scheduledRenewal reports whether the schedule triggered the renewal; only
+// those orders name the installed certificate as replaced
+func scheduledRenewal(reason string) bool {
+	return strings.Contains(reason, scheduledReason)
+}
+
+// renewalReason returns why the installed certificate has to be renewed or an
+// empty string when it is valid, matches the configuration and is not due yet.
+// With dual issuance both variants are checked. A certificate written to the
+// fallback directory is checked there, so it is not issued again. Without a schedule, or when it
+// fails, a certificate is due RenewDays before it expires.
+func renewalReason(config CertificateConfig, now time.Time, schedule renewalSchedule) (string, error) {
+	dir := config.installedDir()
+	if dir != config.Path {
+		fmt.Printf("[%s] Certificate is in the fallback directory %s, copy it to %s\n", config.Name, dir, config.Path)
+	}
+	for _, variant := range config.variants() {
+		path := filepath.Join(dir, variantFileName(config.certFile(), variant.Suffix))
+		reason, err := variantRenewalReason(config, path, variant.KeyType, now, schedule)
+		if err != nil || reason != "" {
+			if reason != "" && variant.Suffix != "" {
+				reason = variant.Suffix + " " + reason
+			}
+			return reason, err
+		}
+	}
+	return "", nil
+}
+
+func variantRenewalReason(config CertificateConfig, path string, keyType certcrypto.KeyType, now time.Time, schedule renewalSchedule) (string, error) {
+	cert, err := readInstalledCertificate(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "no certificate installed", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	remaining := cert.NotAfter.Sub(now)
+	if remaining <= 0 {
+		return "certificate expired", nil
+	}
+
+	if schedule != nil {
+		renewAt, err := schedule(config, cert, now)
+		if err == nil {
+			if !now.Before(renewAt) {
+				return fmt.Sprintf("%s%s reached", scheduledReason, renewAt.UTC().Format(time.RFC3339)), nil
+			}
+		} else {
+			fmt.Printf("[%s] %v, using the renewal window of %d days\n", config.Name, err, config.RenewDays)
+			schedule = nil
+		}
+	}
+	if schedule == nil && remaining <= renewBefore(config, cert) {
+		return fmt.Sprintf("certificate expires in %s", formatRemaining(remaining)), nil
+	}
+
+	if names := certificateNames(cert); !sameDomains(names, config.Domains) {
+		return fmt.Sprintf("domains changed (%s)", strings.Join(names, ", ")), nil
+	}
+
+	if installed := certKeyType(cert); installed != keyType {
+		return fmt.Sprintf("key type changed (%s)", keyTypeName(installed)), nil
+	}
+
+	return "", nil
+}
+
+// renewBefore returns how long before expiry a certificate is renewed: RenewDays,
+// but at most a third of its lifetime so short-lived certificates, e.g. of the
+// shortlived profile, are renewed after two thirds of their lifetime
+func renewBefore(config CertificateConfig, cert *x509.Certificate) time.Duration {
+	window := time.Duration(config.RenewDays) * 24 * time.Hour
+	if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime > 0 && window > lifetime/3 {
+		window = lifetime / 3
+	}
+	return window
+}
+
+// formatRemaining formats a duration in days, or in hours below two days
+func formatRemaining(d time.Duration) string {
+	if d < 48*time.Hour {
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	}
+	return fmt.Sprintf("%d days", int(d.Hours()/24))
+}
+
+// readInstalledCertificate parses the leaf certificate from a PEM file
+func readInstalledCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := certcrypto.ParsePEMCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return cert, nil
+}
+
+// certificateNames returns the DNS names, IP addresses and email addresses a certificate is issued for
+func certificateNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return append(names, cert.EmailAddresses...)
+}
+
+// certKeyType returns the key type of a certificate's public key
+func certKeyType(cert *x509.Certificate) certcrypto.KeyType {
+	return publicKeyType(cert.PublicKey)
+}
+
+// sameDomains reports whether both lists contain the same names in any order
+func sameDomains(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	x := make([]string, len(a))
+	y := make([]string, len(b))
+	for i := range a {
+		x[i] = strings.ToLower(a[i])
+		y[i] = strings.ToLower(b[i])
+	}
+	sort.Strings(x)
+	sort.Strings(y)
+
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// newARISchedule returns the ARI renewal schedule for the configured CA or nil
+// when no account is available, so the renewal window of RenewDays is used
+func newARISchedule(config AcmeConfig) renewalSchedule {
+	user, err := getAccount(config)
+	if err != nil {
+		fmt.Printf("Warning: ARI unavailable, no ACME account: %v\n", err)
+		return nil
+	}
+	client, err := newLegoClient(config, user)
+	if err != nil {
+		fmt.Printf("Warning: ARI unavailable: %v\n", err)
+		return nil
+	}
+
+	return ariSchedule(config.StateDir, func(leaf *x509.Certificate) (*certificate.RenewalInfoResponse, error) {
+		return client.Certificate.GetRenewalInfo(certificate.RenewalInfoRequest{Cert: leaf})
+	})
+}
+
+func init() {
+	renewCmd.Flags().BoolVar(&renewForce, "force", false, "Renew even if the installed certificate is still valid")
+	renewCmd.Flags().IntVar(&renewConcurrency, "concurrency", 0, "Maximum number of certificates renewed at the same time (default ACME_CONCURRENCY or 1)")
+	acmeCmd.AddCommand(renewCmd)
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// newTestCertificate creates a self-signed PEM certificate for domains
+func newTestCertificate(t *testing.T, key crypto.Signer, domains []string, notAfter time.Time) []byte {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return certcrypto.PEMEncode(certcrypto.DERCertificateBytes(der))
+}
+
+func TestRenewalReason(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		key      crypto.Signer
+		domains  []string
+		notAfter time.Time
+		reason   string
+	}{
+		{"valid", ecKey, []string{"nas.example.com"}, now.Add(80 * 24 * time.Hour), ""},
+		{"due", ecKey, []string{"nas.example.com"}, now.Add(10 * 24 * time.Hour), "expires in"},
+		{"expired", ecKey, []string{"nas.example.com"}, now.Add(-time.Hour), "expired"},
+		{"domains", ecKey, []string{"old.example.com"}, now.Add(80 * 24 * time.Hour), "domains changed"},
+		{"key type", rsaKey, []string{"nas.example.com"}, now.Add(80 * 24 * time.Hour), "key type changed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := CertificateConfig{Name: "nas.example.com", Domains: []string{"nas.example.com"}, Path: dir, KeyType: certcrypto.EC256, RenewDays: 30}
+			os.WriteFile(filepath.Join(dir, "nas.example.com.cer"), newTestCertificate(t, tt.key, tt.domains, tt.notAfter), 0644)
+
+			reason, err := renewalReason(config, now, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.reason == "" && reason != "" {
+				t.Errorf("Expected no renewal, got '%s'", reason)
+			}
+			if !strings.Contains(reason, tt.reason) {
+				t.Errorf("Expected reason containing '%s', got '%s'", tt.reason, reason)
+			}
+		})
+	}
+}
+
+func TestRenewalReasonMissing(t *testing.T) {
+	config := CertificateConfig{Name: "nas.example.com", Domains: []string{"nas.example.com"}, Path: t.TempDir(), KeyType: certcrypto.EC256, RenewDays: 30}
+
+	reason, err := renewalReason(config, time.Now(), nil)
+	if err != nil || reason != "no certificate installed" {
+		t.Errorf("Expected 'no certificate installed', got '%s' (%v)", reason, err)
+	}
+}
+
+func TestRenewalReasonFallback(t *testing.T) {
+	t.Chdir(t.TempDir())
+	blocked := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(blocked, nil, 0644)
+
+	config := CertificateConfig{
+		Name:         "nas",
+		Domains:      []string{"nas.example.com"},
+		Path:         filepath.Join(blocked, "certs"),
+		KeyType:      certcrypto.EC256,
+		RenewDays:    30,
+		Deploy:       []string{deployFiles},
+		FallbackFile: filepath.Join(t.TempDir(), "fallback", "nas"),
+	}
+	if err := installCertificate(config, testFiles(t, "nas"), false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if dir := config.installedDir(); !strings.HasPrefix(filepath.Base(dir), "nas-") {
+		t.Errorf("Expected the fallback directory to be recorded, got %s", dir)
+	}
+	reason, err := renewalReason(config, time.Now(), nil)
+	if err != nil || reason != "" {
+		t.Errorf("Expected the certificate in the fallback directory to be up to date, got '%s' (%v)", reason, err)
+	}
+}
+
+func TestSameDomains(t *testing.T) {
+	if !sameDomains([]string{"b.example.com", "A.example.com"}, []string{"a.example.com", "b.example.com"}) {
+		t.Error("Expected domains in different order and case to match")
+	}
+	if sameDomains([]string{"a.example.com"}, []string{"a.example.com", "b.example.com"}) {
+		t.Error("Expected different domain sets not to match")
+	}
+}
+
+func TestRenewBeforeShortLived(t *testing.T) {
+	config := CertificateConfig{RenewDays: 30}
+	now := time.Now()
+
+	long := &x509.Certificate{NotBefore: now, NotAfter: now.Add(90 * 24 * time.Hour)}
+	if d := renewBefore(config, long); d != 30*24*time.Hour {
+		t.Errorf("Expected 30 days for a 90 day certificate, got %s", d)
+	}
+
+	short := &x509.Certificate{NotBefore: now, NotAfter: now.Add(6 * 24 * time.Hour)}
+	if d := renewBefore(config, short); d != 2*24*time.Hour {
+		t.Errorf("Expected 2 days for a 6 day certificate, got %s", d)
+	}
+
+	if s := formatRemaining(36 * time.Hour); s != "36 hours" {
+		t.Errorf("Expected '36 hours', got '%s'", s)
+	}
+}
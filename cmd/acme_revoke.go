@@ -0,0 +1,360 @@
+package cmd
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/spf13/cobra"
+)
+
+var (
+	revokeCertFile   string
+	revokeKeyFile    string
+	revokeUseCertKey bool
+	revokeReason     string
+	revokeDelete     bool
+	revokeArchive    bool
+	revokeReissue    bool
+	revokeYes        bool
+)
+
+// What happens to the local files of a revoked certificate
+const (
+	revokeCleanupDelete  = "delete"
+	revokeCleanupArchive = "archive"
+)
+
+// revocationReasons are the CRL reason codes of RFC 5280 section 5.3.1
+var revocationReasons = map[string]uint{
+	"unspecified":          0,
+	"keycompromise":        1,
+	"cacompromise":         2,
+	"affiliationchanged":   3,
+	"superseded":           4,
+	"cessationofoperation": 5,
+	"certificatehold":      6,
+	"removefromcrl":        8,
+	"privilegewithdrawn":   9,
+	"aacompromise":         10,
+}
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke [name]",
+	Short: "Revoke a managed certificate or a certificate file",
+	Long: `Revoke a managed certificate, or any certificate file given with --cert-file.
+
+The request is signed by the stored ACME account, or by the certificate's own
+private key with --use-cert-key or --key-file, which also works for certificates
+issued to another account. After revoking, the local files of a managed
+certificate can be deleted (--delete) or moved to ACME_STATE_DIR/revoked
+(--archive). With --reissue a replacement with a new key is issued and deployed
+first, the old certificate is only revoked once it is no longer in use.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if !revokeYes {
+			fmt.Println("Error: revocation cannot be undone, pass --yes to confirm")
+			os.Exit(1)
+		}
+		if (len(args) == 1) == (revokeCertFile != "") {
+			fmt.Println("Error: pass either a certificate name or --cert-file")
+			os.Exit(1)
+		}
+		if revokeDelete && revokeArchive {
+			fmt.Println("Error: --delete and --archive cannot be combined")
+			os.Exit(1)
+		}
+
+		reason, err := parseRevocationReason(revokeReason)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if revokeCertFile != "" {
+			if revokeDelete || revokeArchive || revokeReissue || revokeUseCertKey {
+				fmt.Println("Error: --delete, --archive, --reissue and --use-cert-key need a managed certificate name")
+				os.Exit(1)
+			}
+			config := getAcmeConfig()
+			if err := validateAcmeConfig(config); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if err := revokeFile(config, revokeCertFile, revokeKeyFile, reason); err != nil {
+				fmt.Printf("Revocation failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Certificate %s revoked.\n", revokeCertFile)
+			return
+		}
+
+		if revokeReissue && revokeDelete {
+			fmt.Println("Error: --delete cannot be combined with --reissue, the replacement takes the place of the revoked files")
+			os.Exit(1)
+		}
+
+		config, certs := requireCertificates(args)
+		if revokeReissue {
+			// Check the issuing configuration before anything is changed
+			config, certs = requireIssueConfig(args)
+		}
+		cert := certs[0]
+
+		// The revoked certificate is read first, a reissue replaces its files
+		files, err := installedFiles(cert)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		// The replacement is deployed before the certificate in use is revoked
+		if revokeReissue {
+			replacement, err := reissueConfig(cert, reason)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if err := issueCertificate(config, replacement); err != nil {
+				fmt.Printf("Reissue failed, %s was not revoked: %v\n", cert.Name, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Certificate %s reissued.\n", cert.Name)
+		}
+
+		if err := revokeCertificate(config, cert, files, reason, revokeUseCertKey); err != nil {
+			fmt.Printf("Revocation failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Certificate %s revoked.\n", cert.Name)
+
+		cleanup := ""
+		if revokeDelete {
+			cleanup = revokeCleanupDelete
+		} else if revokeArchive {
+			cleanup = revokeCleanupArchive
+		}
+		if err := cleanupRevoked(config, cert, files, cleanup, !revokeReissue); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// parseRevocationReason accepts a reason code or its name such as "keyCompromise"
+func parseRevocationReason(value string) (uint, error) {
+	if code, err := strconv.ParseUint(value, 10, 32); err == nil {
+		for _, c := range revocationReasons {
+			if uint(code) == c {
+				return c, nil
+			}
+		}
+	}
+	if code, ok := revocationReasons[strings.ToLower(strings.ReplaceAll(value, "-", ""))]; ok {
+		return code, nil
+	}
+	return 0, fmt.Errorf("unknown revocation reason %q (use a RFC 5280 code such as 0, 1 or keyCompromise, superseded, cessationOfOperation)", value)
+}
+
+// reissueConfig prepares cert for issuing the replacement of a revoked
+// certificate. The installed key is never reused, and after a key compromise a
+// configured key file or CSR is refused as the replacement would carry its key.
+func reissueConfig(cert CertificateConfig, reason uint) (CertificateConfig, error) {
+	if reason == revocationReasons["keycompromise"] {
+		if cert.KeyFile != "" {
+			return cert, fmt.Errorf("certificate %s uses the key file %s, replace it before reissuing after a key compromise", cert.Name, cert.KeyFile)
+		}
+		if cert.CSR != "" {
+			return cert, fmt.Errorf("certificate %s is issued from the CSR %s, create one with a new key before reissuing after a key compromise", cert.Name, cert.CSR)
+		}
+	}
+	cert.ReuseKey = false
+	return cert, nil
+}
+
+// installedFiles reads the installed output files of every key type variant of
+// cert, from the fallback directory when the certificate was written there
+func installedFiles(cert CertificateConfig) (map[string][]byte, error) {
+	dir := cert.installedDir()
+	files := map[string][]byte{}
+	for _, output := range cert.outputs() {
+		for _, variant := range cert.variants() {
+			name := variantFileName(output.File, variant.Suffix)
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil {
+				files[name] = data
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// revokeCertificate revokes every key type variant of a managed certificate
+// from its installed files, signed by the account or with useCertKey by the
+// certificate's private key
+func revokeCertificate(config AcmeConfig, cert CertificateConfig, files map[string][]byte, reason uint, useCertKey bool) error {
+	for _, variant := range cert.variants() {
+		certName := variantFileName(cert.certFile(), variant.Suffix)
+		certPEM, ok := files[certName]
+		if !ok {
+			return fmt.Errorf("no certificate installed at %s", filepath.Join(cert.installedDir(), certName))
+		}
+		var keyPEM []byte
+		if useCertKey {
+			name := cert.outputFile(outputKey)
+			if name == "" {
+				name = cert.outputFile(outputCombined)
+			}
+			if name == "" {
+				return errors.New("certificate has no key output to sign the revocation with")
+			}
+			if keyPEM, ok = files[variantFileName(name, variant.Suffix)]; !ok {
+				return fmt.Errorf("no private key installed at %s", filepath.Join(cert.installedDir(), variantFileName(name, variant.Suffix)))
+			}
+		}
+		if err := revokePEM(config, certPEM, keyPEM, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupRevoked archives the files of a revoked certificate or deletes them
+// depending on cleanup. They are only removed from the installed directory with
+// remove, files already replaced by a reissued certificate are just archived.
+func cleanupRevoked(config AcmeConfig, cert CertificateConfig, files map[string][]byte, cleanup string, remove bool) error {
+	switch cleanup {
+	case revokeCleanupArchive:
+		archived := cert
+		archived.BackupDir = filepath.Join(config.StateDir, "revoked", cert.Name)
+		archived.Backups = 0
+		path, err := writeBackup(archived, files)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked certificate archived to %s\n", path)
+	case revokeCleanupDelete:
+	default:
+		return nil
+	}
+	if !remove {
+		return nil
+	}
+	if err := removeFiles(cert.installedDir(), files); err != nil {
+		return err
+	}
+	// Renewals look for the certificate in cert.Path again
+	return recordFallback(cert, "", false)
+}
+
+// revokeFile revokes the certificate in certFile. Without keyFile the stored
+// account signs the request, otherwise the certificate's private key does.
+func revokeFile(config AcmeConfig, certFile, keyFile string, reason uint) error {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	var keyPEM []byte
+	if keyFile != "" {
+		if keyPEM, err = os.ReadFile(keyFile); err != nil {
+			return err
+		}
+	}
+	return revokePEM(config, certPEM, keyPEM, reason)
+}
+
+// revokePEM revokes the certificate in certPEM. Without keyPEM the stored account
+// signs the request, otherwise the certificate's private key does.
+func revokePEM(config AcmeConfig, certPEM, keyPEM []byte, reason uint) error {
+	if keyPEM == nil {
+		if config.Email == "" {
+			return errors.New("ACME_EMAIL is required to revoke with the account, or use the certificate key")
+		}
+		_, client, err := loadRegisteredAccount(config)
+		if err != nil {
+			return err
+		}
+		return client.Certificate.RevokeWithReason(certPEM, &reason)
+	}
+
+	leaf, err := certcrypto.ParsePEMCertificate(certPEM)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	if err := keyMatches(keyPEM, leaf); err != nil {
+		return err
+	}
+	key, err := certcrypto.ParsePEMPrivateKey(keyPEM)
+	if err != nil {
+		return err
+	}
+
+	legoConfig, err := newLegoConfig(config, &User{})
+	if err != nil {
+		return err
+	}
+	return revokeWithCertificateKey(legoConfig.HTTPClient, config.CADirURL, leaf.Raw, key, reason)
+}
+
+// revokeWithCertificateKey sends a revokeCert request signed by the certificate's
+// own key following RFC 8555 section 7.6
+func revokeWithCertificateKey(httpClient *http.Client, dirURL string, certDER []byte, key crypto.PrivateKey, reason uint) error {
+	directory, nonce, err := getDirectoryNonce(httpClient, dirURL)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(map[string]any{
+		"certificate": base64.RawURLEncoding.EncodeToString(certDER),
+		"reason":      reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	body, err := signJWS(key, payload, map[jose.HeaderKey]any{
+		"url":   directory.RevokeCertURL,
+		"nonce": nonce,
+	}, true)
+	if err != nil {
+		return err
+	}
+
+	if err := postJWS(httpClient, directory.RevokeCertURL, body); err != nil {
+		return fmt.Errorf("revokeCert returned %v", err)
+	}
+	return nil
+}
+
+// removeFiles deletes the given files from dir
+func removeFiles(dir string, files map[string][]byte) error {
+	for name := range files {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	revokeCmd.Flags().StringVar(&revokeCertFile, "cert-file", "", "Revoke this certificate file instead of a managed certificate")
+	revokeCmd.Flags().StringVar(&revokeKeyFile, "key-file", "", "Sign with this certificate private key instead of the account (with --cert-file)")
+	revokeCmd.Flags().BoolVar(&revokeUseCertKey, "use-cert-key", false, "Sign with the installed private key of the managed certificate instead of the account")
+	revokeCmd.Flags().StringVar(&revokeReason, "reason", "unspecified", "RFC 5280 reason code or name, e.g. keyCompromise, superseded, cessationOfOperation")
+	revokeCmd.Flags().BoolVar(&revokeDelete, "delete", false, "Delete the local certificate files after revoking")
+	revokeCmd.Flags().BoolVar(&revokeArchive, "archive", false, "Move the local certificate files to ACME_STATE_DIR/revoked after revoking")
+	revokeCmd.Flags().BoolVar(&revokeReissue, "reissue", false, "Issue and deploy a replacement certificate before revoking")
+	revokeCmd.Flags().BoolVar(&revokeYes, "yes", false, "Confirm the revocation")
+	acmeCmd.AddCommand(revokeCmd)
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-jose/go-jose/v4"
+)
+
+func TestParseRevocationReason(t *testing.T) {
+	tests := map[string]uint{"0": 0, "keyCompromise": 1, "cessation-of-operation": 5, "9": 9}
+	for value, expected := range tests {
+		if code, err := parseRevocationReason(value); err != nil || code != expected {
+			t.Errorf("Expected %d for %s, got %d (%v)", expected, value, code, err)
+		}
+	}
+
+	for _, value := range []string{"7", "stolen"} {
+		if _, err := parseRevocationReason(value); err == nil {
+			t.Errorf("Expected error for %s", value)
+		}
+	}
+}
+
+func TestRevokeCertificateWithCertKey(t *testing.T) {
+	dir := t.TempDir()
+	files := testFiles(t, "nas")
+	for name, content := range files {
+		os.WriteFile(filepath.Join(dir, name), content, 0600)
+	}
+	leaf, _ := certcrypto.ParsePEMCertificate(files["nas.cer"])
+
+	var server *httptest.Server
+	revoked := false
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dir":
+			json.NewEncoder(w).Encode(acme.Directory{NewNonceURL: server.URL + "/nonce", RevokeCertURL: server.URL + "/revoke"})
+		case "/nonce":
+			w.Header().Set("Replay-Nonce", "nonce-1")
+		case "/revoke":
+			body, _ := io.ReadAll(r.Body)
+			signed, err := jose.ParseSigned(string(body), []jose.SignatureAlgorithm{jose.ES256})
+			if err != nil {
+				t.Errorf("Failed to parse JWS: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			jwk := signed.Signatures[0].Protected.JSONWebKey
+			if jwk == nil {
+				t.Error("Expected embedded JWK")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			payload, err := signed.Verify(jwk)
+			if err != nil {
+				t.Errorf("Invalid signature: %v", err)
+			}
+
+			var request struct {
+				Certificate string `json:"certificate"`
+				Reason      uint   `json:"reason"`
+			}
+			json.Unmarshal(payload, &request)
+			der, _ := base64.RawURLEncoding.DecodeString(request.Certificate)
+			if string(der) != string(leaf.Raw) || request.Reason != 1 {
+				t.Errorf("Unexpected revocation request: reason %d", request.Reason)
+			}
+			revoked = true
+		}
+	}))
+	defer server.Close()
+
+	config := AcmeConfig{CADirURL: server.URL + "/dir", StateDir: t.TempDir()}
+	cert := CertificateConfig{Name: "nas", Path: dir}
+	installed, err := installedFiles(cert)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := revokeCertificate(config, cert, installed, 1, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !revoked {
+		t.Error("Expected revokeCert request")
+	}
+
+	if err := cleanupRevoked(config, cert, installed, revokeCleanupArchive, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nas.cer")); !os.IsNotExist(err) {
+		t.Error("Expected certificate to be removed from the output directory")
+	}
+	archived, _ := listBackups(CertificateConfig{BackupDir: filepath.Join(config.StateDir, "revoked", "nas")})
+	if len(archived) != 1 {
+		t.Fatalf("Expected one archive, got %v", archived)
+	}
+	if _, err := os.Stat(filepath.Join(config.StateDir, "revoked", "nas", archived[0], "nas.key")); err != nil {
+		t.Errorf("Expected archived key: %v", err)
+	}
+}
+
+func TestRevokeFallbackFiles(t *testing.T) {
+	fallback := t.TempDir()
+	for name, content := range testFiles(t, "nas") {
+		os.WriteFile(filepath.Join(fallback, name), content, 0600)
+	}
+	record := filepath.Join(t.TempDir(), "nas")
+	os.WriteFile(record, []byte(fallback+"\n"), 0600)
+
+	config := AcmeConfig{StateDir: t.TempDir()}
+	cert := CertificateConfig{Name: "nas", Path: t.TempDir(), FallbackFile: record}
+	installed, err := installedFiles(cert)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := installed["nas.cer"]; !ok {
+		t.Fatalf("Expected the files of the fallback directory, got %d files", len(installed))
+	}
+
+	if err := cleanupRevoked(config, cert, installed, revokeCleanupDelete, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fallback, "nas.cer")); !os.IsNotExist(err) {
+		t.Error("Expected certificate to be removed from the fallback directory")
+	}
+	if _, err := os.Stat(record); !os.IsNotExist(err) {
+		t.Error("Expected the fallback record to be removed")
+	}
+}
+
+func TestReissueConfig(t *testing.T) {
+	cert := CertificateConfig{Name: "nas", ReuseKey: true}
+	reissue, err := reissueConfig(cert, 1)
+	if err != nil || reissue.ReuseKey {
+		t.Errorf("Expected the installed key not to be reused, got %v (%v)", reissue.ReuseKey, err)
+	}
+
+	cert.KeyFile = "/etc/ssl/nas.key"
+	if _, err := reissueConfig(cert, 1); err == nil {
+		t.Error("Expected a configured key file to be refused after a key compromise")
+	}
+	if _, err := reissueConfig(cert, 4); err != nil {
+		t.Errorf("Unexpected error for superseded: %v", err)
+	}
+
+	cert.KeyFile, cert.CSR = "", "/etc/ssl/nas.csr"
+	if _, err := reissueConfig(cert, 1); err == nil {
+		t.Error("Expected a configured CSR to be refused after a key compromise")
+	}
+}
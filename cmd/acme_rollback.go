@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var rollbackList bool
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback [name...]",
+	Short: "Restore the previously installed certificate and re-run the deploy hooks",
+	Long: `Restore the most recent backup of each selected certificate, deploy it to the
+configured targets and run the deploy hooks again. The restored backup is removed
+once its files are installed, also when a deploy hook fails afterwards, so running
+rollback again goes back one more version.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		_, certs := requireCertificates(args)
+
+		if rollbackList {
+			for _, cert := range certs {
+				backups, err := listBackups(cert)
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(1)
+				}
+				for i := len(backups) - 1; i >= 0; i-- {
+					fmt.Printf("%s\t%s\n", cert.Name, backups[i])
+				}
+			}
+			return
+		}
+
+		results := make([]certificateResult, 0, len(certs))
+		for _, cert := range certs {
+			result := certificateResult{Name: cert.Name, Status: "restored"}
+			backup, err := rollbackCertificate(cert)
+			if err != nil {
+				result.Status, result.Detail = "failed", err.Error()
+			} else {
+				result.Detail = backup
+			}
+			results = append(results, result)
+		}
+
+		if printCertificateResults(os.Stdout, results) {
+			os.Exit(1)
+		}
+	},
+}
+
+// rollbackCertificate restores the newest backup of cert
+func rollbackCertificate(cert CertificateConfig) (string, error) {
+	backups, err := listBackups(cert)
+	if err != nil {
+		return "", err
+	}
+	if len(backups) == 0 {
+		return "", errors.New("no backup available")
+	}
+	name := backups[len(backups)-1]
+	return name, restoreBackup(cert, name)
+}
+
+// restoreBackup installs a backup of cert without backing up the current files,
+// re-runs the deploy targets and hooks and removes the backup. The backup is also
+// removed when a later deploy step fails, as its files are installed by then.
+func restoreBackup(cert CertificateConfig, name string) error {
+	files, err := readBackup(cert, name)
+	if err != nil {
+		return fmt.Errorf("failed to read backup %s: %v", name, err)
+	}
+	installErr := installCertificate(cert, files, false)
+	if installErr != nil && !errors.Is(installErr, errCertificateInstalled) {
+		return fmt.Errorf("backup %s: %v", name, installErr)
+	}
+
+	if err := os.RemoveAll(filepath.Join(cert.BackupDir, name)); err != nil {
+		return fmt.Errorf("restored backup %s but failed to remove it: %v", name, err)
+	}
+	if installErr != nil {
+		return fmt.Errorf("backup %s: %w", name, installErr)
+	}
+	return nil
+}
+
+func init() {
+	rollbackCmd.Flags().BoolVar(&rollbackList, "list", false, "List the available backups instead of restoring")
+	acmeCmd.AddCommand(rollbackCmd)
+}
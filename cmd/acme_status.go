@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Certificate states reported by acme list and acme status
+const (
+	statusOK      = "ok"
+	statusWarning = "warning"
+	statusExpired = "expired"
+	statusMissing = "missing"
+	statusKey     = "key mismatch"
+	statusError   = "error"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+
+	defaultWarnDays = 14
+)
+
+var (
+	statusOutput   string
+	statusWarnDays int
+)
+
+// certificateStatus describes an installed certificate
+type certificateStatus struct {
+	Name          string    `json:"name"`
+	Variant       string    `json:"variant,omitempty"`
+	Path          string    `json:"path"`
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"`
+	Subject       string    `json:"subject,omitempty"`
+	DNSNames      []string  `json:"dns_names,omitempty"`
+	Issuer        string    `json:"issuer,omitempty"`
+	KeyType       string    `json:"key_type,omitempty"`
+	NotBefore     time.Time `json:"not_before,omitzero"`
+	NotAfter      time.Time `json:"not_after,omitzero"`
+	DaysRemaining int       `json:"days_remaining"`
+	Serial        string    `json:"serial,omitempty"`
+	KeyMatches    bool      `json:"key_matches"`
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list [name...]",
+	Short: "List the managed certificates",
+	Run: func(cmd *cobra.Command, args []string) {
+		runStatus(cmd, args, printCertificateList)
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status [name...]",
+	Short: "Show details of the installed certificates",
+	Long: `Show details of the installed certificates. The command exits with status 1
+when a certificate is missing, expired, within --warn-days of its expiry or
+installed next to a key that does not belong to it, so it can be used as a
+monitoring check.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runStatus(cmd, args, printCertificateStatus)
+	},
+}
+
+func runStatus(cmd *cobra.Command, args []string, printTable func(io.Writer, []certificateStatus)) {
+	if statusOutput != outputTable && statusOutput != outputJSON {
+		fmt.Printf("Error: unsupported output %q (use table or json)\n", statusOutput)
+		os.Exit(1)
+	}
+
+	_, certs := requireCertificates(args)
+
+	warnDays := getEnvInt("ACME_WARN_DAYS", defaultWarnDays)
+	if cmd.Flags().Changed("warn-days") {
+		warnDays = statusWarnDays
+	}
+
+	statuses := certificateStatuses(certs, time.Now(), warnDays)
+	if statusOutput == outputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(statuses)
+	} else {
+		printTable(os.Stdout, statuses)
+	}
+
+	for _, status := range statuses {
+		if status.Status != statusOK {
+			os.Exit(1)
+		}
+	}
+}
+
+// certificateStatuses reads the installed files of every certificate variant
+func certificateStatuses(certs []CertificateConfig, now time.Time, warnDays int) []certificateStatus {
+	var statuses []certificateStatus
+	for _, cert := range certs {
+		for _, variant := range cert.variants() {
+			statuses = append(statuses, variantStatus(cert, variant, now, warnDays))
+		}
+	}
+	return statuses
+}
+
+func variantStatus(cert CertificateConfig, variant certificateVariant, now time.Time, warnDays int) certificateStatus {
+	// A certificate written to the fallback directory is reported from there
+	dir := cert.installedDir()
+	status := certificateStatus{
+		Name:    cert.Name,
+		Variant: variant.Suffix,
+		Path:    filepath.Join(dir, variantFileName(cert.certFile(), variant.Suffix)),
+	}
+
+	installed, err := readInstalledCertificate(status.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		status.Status = statusMissing
+		return status
+	}
+	if err != nil {
+		status.Status, status.Error = statusError, err.Error()
+		return status
+	}
+
+	status.Subject = installed.Subject.String()
+	status.DNSNames = installed.DNSNames
+	status.Issuer = installed.Issuer.String()
+	status.KeyType = keyTypeName(certKeyType(installed))
+	status.NotBefore = installed.NotBefore
+	status.NotAfter = installed.NotAfter
+	status.DaysRemaining = int(installed.NotAfter.Sub(now).Hours() / 24)
+	status.Serial = fmt.Sprintf("%x", installed.SerialNumber)
+
+	keyFile := cert.outputFile(outputKey)
+	if keyFile == "" {
+		keyFile = cert.outputFile(outputCombined)
+	}
+	if keyFile != "" {
+		keyPEM, err := os.ReadFile(filepath.Join(dir, variantFileName(keyFile, variant.Suffix)))
+		if err == nil {
+			err = keyMatches(keyPEM, installed)
+		}
+		status.KeyMatches = err == nil
+		if err != nil {
+			status.Error = err.Error()
+		}
+	}
+
+	switch {
+	case !installed.NotAfter.After(now):
+		status.Status = statusExpired
+	case keyFile != "" && !status.KeyMatches:
+		status.Status = statusKey
+	case installed.NotAfter.Sub(now) <= warnBefore(installed, warnDays):
+		status.Status = statusWarning
+	default:
+		status.Status = statusOK
+	}
+	return status
+}
+
+// warnBefore returns how long before expiry a certificate is reported. For
+// certificates living less than twice that long, e.g. six day certificates,
+// a sixth of the lifetime is used so normal renewals do not raise warnings.
+func warnBefore(cert *x509.Certificate, warnDays int) time.Duration {
+	warn := time.Duration(warnDays) * 24 * time.Hour
+	if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime > 0 && warn*2 > lifetime {
+		warn = lifetime / 6
+	}
+	return warn
+}
+
+// printCertificateList writes one line per certificate
+func printCertificateList(w io.Writer, statuses []certificateStatus) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tDOMAINS\tKEY TYPE\tNOT AFTER\tDAYS\tSTATUS")
+	for _, status := range statuses {
+		name := status.Name
+		if status.Variant != "" {
+			name += " (" + status.Variant + ")"
+		}
+		notAfter := "-"
+		if !status.NotAfter.IsZero() {
+			notAfter = status.NotAfter.UTC().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", name, strings.Join(status.DNSNames, ","), status.KeyType, notAfter, status.DaysRemaining, status.Status)
+	}
+	tw.Flush()
+}
+
+// printCertificateStatus writes the details of every certificate
+func printCertificateStatus(w io.Writer, statuses []certificateStatus) {
+	for i, status := range statuses {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		name := status.Name
+		if status.Variant != "" {
+			name += " (" + status.Variant + ")"
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+		fmt.Fprintf(tw, "%s\n", name)
+		fmt.Fprintf(tw, "  Status:\t%s\n", status.Status)
+		fmt.Fprintf(tw, "  Path:\t%s\n", status.Path)
+		if status.Error != "" {
+			fmt.Fprintf(tw, "  Error:\t%s\n", status.Error)
+		}
+		if status.Status != statusMissing && status.Subject != "" {
+			fmt.Fprintf(tw, "  Subject:\t%s\n", status.Subject)
+			fmt.Fprintf(tw, "  SANs:\t%s\n", strings.Join(status.DNSNames, ", "))
+			fmt.Fprintf(tw, "  Issuer:\t%s\n", status.Issuer)
+			fmt.Fprintf(tw, "  Key type:\t%s\n", status.KeyType)
+			fmt.Fprintf(tw, "  Not before:\t%s\n", status.NotBefore.UTC().Format(time.RFC3339))
+			fmt.Fprintf(tw, "  Not after:\t%s\n", status.NotAfter.UTC().Format(time.RFC3339))
+			fmt.Fprintf(tw, "  Days remaining:\t%d\n", status.DaysRemaining)
+			fmt.Fprintf(tw, "  Serial:\t%s\n", status.Serial)
+			fmt.Fprintf(tw, "  Key matches:\t%t\n", status.KeyMatches)
+		}
+		tw.Flush()
+	}
+}
+
+func init() {
+	for _, c := range []*cobra.Command{listCmd, statusCmd} {
+		c.Flags().StringVarP(&statusOutput, "output", "o", outputTable, "Output format: table or json")
+		c.Flags().IntVar(&statusWarnDays, "warn-days", 0, fmt.Sprintf("Exit non-zero when a certificate expires within this many days (default ACME_WARN_DAYS or %d)", defaultWarnDays))
+		acmeCmd.AddCommand(c)
+	}
+}
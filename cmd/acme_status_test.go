@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertificateStatuses(t *testing.T) {
+	valid := t.TempDir()
+	for name, content := range testFiles(t, "valid") {
+		os.WriteFile(filepath.Join(valid, name), content, 0600)
+	}
+
+	mismatch := t.TempDir()
+	files := testFiles(t, "mismatch")
+	os.WriteFile(filepath.Join(mismatch, "mismatch.cer"), files["mismatch.cer"], 0644)
+	os.WriteFile(filepath.Join(mismatch, "mismatch.key"), testFiles(t, "other")["other.key"], 0600)
+
+	certs := []CertificateConfig{
+		{Name: "valid", Path: valid},
+		{Name: "mismatch", Path: mismatch},
+		{Name: "missing", Path: t.TempDir()},
+	}
+
+	statuses := certificateStatuses(certs, time.Now(), 14)
+	expected := []string{statusOK, statusKey, statusMissing}
+	for i, status := range statuses {
+		if status.Status != expected[i] {
+			t.Errorf("Expected %s to be %s, got %s (%s)", status.Name, expected[i], status.Status, status.Error)
+		}
+	}
+	if !statuses[0].KeyMatches || statuses[0].DNSNames[0] != "valid.example.com" || statuses[0].Issuer != "CN=Test CA" {
+		t.Errorf("Unexpected status: %+v", statuses[0])
+	}
+
+	if status := certificateStatuses(certs[:1], time.Now().Add(80*24*time.Hour), 14)[0]; status.Status != statusWarning {
+		t.Errorf("Expected warning inside the threshold, got %s", status.Status)
+	}
+	if status := certificateStatuses(certs[:1], time.Now().Add(100*24*time.Hour), 14)[0]; status.Status != statusExpired {
+		t.Errorf("Expected expired certificate, got %s", status.Status)
+	}
+
+	var out bytes.Buffer
+	printCertificateList(&out, statuses)
+	if !strings.Contains(out.String(), "valid.example.com") || !strings.Contains(out.String(), "key mismatch") {
+		t.Errorf("Unexpected list output: %q", out.String())
+	}
+}
+
+func TestCertificateStatusFallback(t *testing.T) {
+	fallback := t.TempDir()
+	for name, content := range testFiles(t, "nas") {
+		os.WriteFile(filepath.Join(fallback, name), content, 0600)
+	}
+	record := filepath.Join(t.TempDir(), "nas")
+	os.WriteFile(record, []byte(fallback+"\n"), 0600)
+
+	cert := CertificateConfig{Name: "nas", Path: t.TempDir(), FallbackFile: record}
+	status := certificateStatuses([]CertificateConfig{cert}, time.Now(), 14)[0]
+	if status.Status != statusOK || !status.KeyMatches || filepath.Dir(status.Path) != fallback {
+		t.Errorf("Expected the certificate in the fallback directory, got %+v", status)
+	}
+}
+
+func TestWarnBeforeShortLived(t *testing.T) {
+	now := time.Now()
+	if d := warnBefore(&x509.Certificate{NotBefore: now, NotAfter: now.Add(90 * 24 * time.Hour)}, 14); d != 14*24*time.Hour {
+		t.Errorf("Expected 14 days for a 90 day certificate, got %s", d)
+	}
+	if d := warnBefore(&x509.Certificate{NotBefore: now, NotAfter: now.Add(6 * 24 * time.Hour)}, 14); d != 24*time.Hour {
+		t.Errorf("Expected 1 day for a 6 day certificate, got %s", d)
+	}
+}
@@ -0,0 +1,350 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const deploySynology = "synology"
+
+// Locations of the DSM certificate store relative to the Synology root
+const (
+	synologyCertDir    = "usr/syno/etc/certificate"
+	synologyPkgCertDir = "usr/local/etc/certificate"
+)
+
+// synologyNginxSubscribers are the DSM services served by nginx
+var synologyNginxSubscribers = map[string]bool{
+	"system":       true,
+	"ReverseProxy": true,
+}
+
+// synologyService is a service bound to a certificate in the DSM archive.
+// Fields DSM adds that are not modeled here are kept in extra and written back.
+type synologyService struct {
+	DisplayName string `json:"display_name"`
+	IsPkg       bool   `json:"isPkg"`
+	Owner       string `json:"owner"`
+	Service     string `json:"service"`
+	Subscriber  string `json:"subscriber"`
+
+	extra map[string]json.RawMessage
+}
+
+func (s *synologyService) UnmarshalJSON(data []byte) error {
+	type plain synologyService
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.extra)
+}
+
+func (s synologyService) MarshalJSON() ([]byte, error) {
+	type plain synologyService
+	return marshalWithExtra(plain(s), s.extra)
+}
+
+// synologyArchiveEntry is one certificate of the DSM archive INFO file.
+// Fields DSM adds that are not modeled here are kept in extra and written back.
+type synologyArchiveEntry struct {
+	Desc          string            `json:"desc"`
+	Services      []synologyService `json:"services"`
+	UserDeletable *bool             `json:"user_deletable,omitempty"`
+
+	extra map[string]json.RawMessage
+}
+
+func (e *synologyArchiveEntry) UnmarshalJSON(data []byte) error {
+	type plain synologyArchiveEntry
+	if err := json.Unmarshal(data, (*plain)(e)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &e.extra)
+}
+
+func (e synologyArchiveEntry) MarshalJSON() ([]byte, error) {
+	type plain synologyArchiveEntry
+	return marshalWithExtra(plain(e), e.extra)
+}
+
+// marshalWithExtra encodes v and adds the fields of extra that v does not set
+func marshalWithExtra(v any, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	fields := map[string]json.RawMessage{}
+	for key, value := range extra {
+		fields[key] = value
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// deploySynologyCertificate installs the certificate into the DSM certificate
+// archive, refreshes the copies of every service bound to it and reloads them
+func deploySynologyCertificate(cert CertificateConfig, files map[string][]byte) error {
+	fullchain := files[cert.outputFile(outputFullchain)]
+	leaf, chain := splitPEMChain(fullchain)
+	if len(leaf) == 0 {
+		return errors.New("synology: no certificate to deploy")
+	}
+	pemFiles := map[string][]byte{
+		"cert.pem":      leaf,
+		"chain.pem":     chain,
+		"fullchain.pem": fullchain,
+		"privkey.pem":   files[cert.outputFile(outputKey)],
+	}
+
+	archiveDir := filepath.Join(cert.SynologyRoot, synologyCertDir, "_archive")
+	info, err := readSynologyInfo(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	id := synologyArchiveID(info, cert.SynologyDesc)
+	if id == "" {
+		if id, err = newSynologyArchiveID(info); err != nil {
+			return err
+		}
+		info[id] = &synologyArchiveEntry{Desc: cert.SynologyDesc, Services: []synologyService{}}
+		fmt.Printf("[%s] Created DSM certificate %s (%s)\n", cert.Name, id, cert.SynologyDesc)
+	}
+
+	if err := writeSynologyFiles(filepath.Join(archiveDir, id), pemFiles, ""); err != nil {
+		return err
+	}
+
+	defaultFile := filepath.Join(archiveDir, "DEFAULT")
+	current, err := os.ReadFile(defaultFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("synology: %v", err)
+	}
+	if cert.SynologyDefault || len(bytes.TrimSpace(current)) == 0 {
+		if err := os.WriteFile(defaultFile, []byte(id), 0600); err != nil {
+			return fmt.Errorf("synology: failed to set default certificate: %v", err)
+		}
+	}
+
+	if err := writeSynologyInfo(archiveDir, info); err != nil {
+		return err
+	}
+
+	for _, service := range info[id].Services {
+		if err := writeSynologyFiles(synologyServiceDir(cert.SynologyRoot, service), pemFiles, service.Owner); err != nil {
+			return err
+		}
+	}
+
+	return reloadSynologyServices(cert, info[id].Services)
+}
+
+// readSynologyInfo reads the INFO file of the DSM certificate archive
+func readSynologyInfo(archiveDir string) (map[string]*synologyArchiveEntry, error) {
+	info := map[string]*synologyArchiveEntry{}
+	data, err := os.ReadFile(filepath.Join(archiveDir, "INFO"))
+	if errors.Is(err, os.ErrNotExist) {
+		return info, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("synology: %v", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return info, nil
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("synology: failed to parse %s: %v", filepath.Join(archiveDir, "INFO"), err)
+	}
+	return info, nil
+}
+
+// writeSynologyInfo replaces the INFO file of the DSM certificate archive
+func writeSynologyInfo(archiveDir string, info map[string]*synologyArchiveEntry) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("synology: %v", err)
+	}
+	path := filepath.Join(archiveDir, "INFO")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("synology: failed to write INFO: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("synology: failed to write INFO: %v", err)
+	}
+	return nil
+}
+
+// synologyArchiveID returns the archive id of the certificate with the given description
+func synologyArchiveID(info map[string]*synologyArchiveEntry, desc string) string {
+	ids := make([]string, 0, len(info))
+	for id := range info {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if info[id] != nil && info[id].Desc == desc {
+			return id
+		}
+	}
+	return ""
+}
+
+// newSynologyArchiveID returns a random archive id in the format used by DSM
+func newSynologyArchiveID(info map[string]*synologyArchiveEntry) (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	for {
+		id := make([]byte, 6)
+		for i := range id {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+			if err != nil {
+				return "", fmt.Errorf("synology: %v", err)
+			}
+			id[i] = letters[n.Int64()]
+		}
+		if _, exists := info[string(id)]; !exists {
+			return string(id), nil
+		}
+	}
+}
+
+// synologyServiceDir returns the directory holding the certificate copy of a service
+func synologyServiceDir(root string, service synologyService) string {
+	base := synologyCertDir
+	if service.IsPkg {
+		base = synologyPkgCertDir
+	}
+	return filepath.Join(root, base, service.Subscriber, service.Service)
+}
+
+// writeSynologyFiles writes the PEM files into dir, owned by owner if that user exists
+func writeSynologyFiles(dir string, files map[string][]byte, owner string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("synology: %v", err)
+	}
+
+	uid, gid := -1, -1
+	if owner != "" && owner != "root" {
+		if u, err := user.Lookup(owner); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+
+	for name, content := range files {
+		perm := os.FileMode(0644)
+		if name == "privkey.pem" {
+			perm = 0600
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, perm); err != nil {
+			return fmt.Errorf("synology: failed to write %s: %v", path, err)
+		}
+		if uid >= 0 {
+			if err := os.Chown(path, uid, gid); err != nil {
+				return fmt.Errorf("synology: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseSynologyReloads parses subscriber=command entries
+func parseSynologyReloads(values []string) (map[string][]Hook, error) {
+	reloads := map[string][]Hook{}
+	for _, value := range values {
+		subscriber, command, found := strings.Cut(value, "=")
+		subscriber = strings.TrimSpace(subscriber)
+		if !found || subscriber == "" {
+			return nil, fmt.Errorf("invalid synology reload %q (use subscriber=command)", value)
+		}
+		hooks, err := parseHooks(command)
+		if err != nil {
+			return nil, err
+		}
+		reloads[subscriber] = hooks
+	}
+	return reloads, nil
+}
+
+// synologyReloadHooks returns the commands reloading the given services and the
+// subscribers it has no command for. Configured reloads take precedence, packages
+// are restarted with synopkg and services served by nginx reload nginx.
+func synologyReloadHooks(root string, services []synologyService, reloads map[string][]Hook) ([]Hook, []string) {
+	var hooks []Hook
+	var unknown []string
+	seen := map[string]bool{}
+	add := func(hook Hook) {
+		if seen[hook.String()] {
+			return
+		}
+		seen[hook.String()] = true
+		hooks = append(hooks, hook)
+	}
+
+	for _, service := range services {
+		switch configured, ok := reloads[service.Subscriber]; {
+		case ok:
+			for _, hook := range configured {
+				add(hook)
+			}
+		case service.IsPkg:
+			add(Hook{Command: filepath.Join(root, "usr/syno/bin/synopkg"), Args: []string{"restart", service.Subscriber}})
+		case synologyNginxSubscribers[service.Subscriber]:
+			if _, err := os.Stat(filepath.Join(root, "usr/syno/bin/synosystemctl")); err == nil {
+				add(Hook{Command: filepath.Join(root, "usr/syno/bin/synosystemctl"), Args: []string{"reload", "nginx"}})
+			} else {
+				add(Hook{Command: filepath.Join(root, "usr/syno/sbin/synoservicectl"), Args: []string{"--reload", "nginx"}})
+			}
+		default:
+			if !seen["unknown:"+service.Subscriber] {
+				seen["unknown:"+service.Subscriber] = true
+				unknown = append(unknown, service.Subscriber)
+			}
+		}
+	}
+	return hooks, unknown
+}
+
+// reloadSynologyServices reloads the services using the certificate. Built-in
+// commands that do not exist on this system are skipped, services without a
+// known reload command are reported.
+func reloadSynologyServices(cert CertificateConfig, services []synologyService) error {
+	hooks, unknown := synologyReloadHooks(cert.SynologyRoot, services, cert.SynologyReload)
+	for _, subscriber := range unknown {
+		fmt.Printf("[%s] Warning: no reload command for the DSM service %s, it keeps the old certificate until restarted (set ACME_SYNOLOGY_RELOAD=%s=<command>)\n",
+			cert.Name, subscriber, subscriber)
+	}
+
+	var failed []string
+	for _, hook := range hooks {
+		if _, err := exec.LookPath(hook.Command); err != nil {
+			fmt.Printf("[%s] Skipping %s: %v\n", cert.Name, hook, err)
+			continue
+		}
+		result := runHook(hook, nil, cert.HookTimeout)
+		if result.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", hook, result.Err))
+			continue
+		}
+		fmt.Printf("[%s] Reloaded: %s\n", cert.Name, hook)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("synology: reload failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
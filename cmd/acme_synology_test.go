@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeSynology creates a DSM like certificate store with one certificate
+// bound to DSM and the VPN Server package and fake reload commands
+func newFakeSynology(t *testing.T) (string, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	calls := filepath.Join(root, "calls")
+	archive := filepath.Join(root, synologyCertDir, "_archive")
+	os.MkdirAll(filepath.Join(archive, "AbC123"), 0755)
+	os.WriteFile(filepath.Join(archive, "DEFAULT"), []byte("AbC123"), 0600)
+	os.WriteFile(filepath.Join(archive, "INFO"), []byte(`{"AbC123":{"desc":"nas","services":[
+		{"display_name":"DSM Desktop Service","display_name_i18n":"common:web_desktop","isPkg":false,"owner":"root","service":"default","subscriber":"system","multiple_cert":true,"user_setable":true},
+		{"display_name":"VPN Server","isPkg":true,"owner":"VPNCenter","service":"OpenVPN","subscriber":"VPNCenter"}
+	],"user_deletable":true,"is_broken":false}}`), 0600)
+
+	script := "#!/bin/sh\necho \"$(basename \"$0\") $*\" >> " + calls + "\n"
+	for _, command := range []string{"usr/syno/bin/synopkg", "usr/syno/bin/synosystemctl"} {
+		path := filepath.Join(root, command)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(script), 0755)
+	}
+	return root, calls
+}
+
+func TestDeploySynologyCertificate(t *testing.T) {
+	root, calls := newFakeSynology(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := newTestCertificate(t, key, []string{"nas.example.com"}, time.Now().Add(90*24*time.Hour))
+	issuer := newTestCertificate(t, key, []string{"Test CA"}, time.Now().Add(365*24*time.Hour))
+	files := map[string][]byte{
+		"nas.cer": append(append([]byte{}, leaf...), issuer...),
+		"nas.key": []byte("KEY"),
+	}
+
+	cert := CertificateConfig{Name: "nas", SynologyRoot: root, SynologyDesc: "nas", HookTimeout: 10 * time.Second}
+	if err := deploySynologyCertificate(cert, files); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, dir := range []string{
+		filepath.Join(root, synologyCertDir, "_archive", "AbC123"),
+		filepath.Join(root, synologyCertDir, "system", "default"),
+		filepath.Join(root, synologyPkgCertDir, "VPNCenter", "OpenVPN"),
+	} {
+		if data, _ := os.ReadFile(filepath.Join(dir, "cert.pem")); string(data) != string(leaf) {
+			t.Errorf("Expected leaf certificate in %s", dir)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "chain.pem")); string(data) != string(issuer) {
+			t.Errorf("Expected issuer certificate in %s", dir)
+		}
+		if info, err := os.Stat(filepath.Join(dir, "privkey.pem")); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Expected private key with permissions 0600 in %s (%v)", dir, err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "privkey.pem")); string(data) != "KEY" {
+			t.Errorf("Expected private key in %s", dir)
+		}
+	}
+
+	data, _ := os.ReadFile(calls)
+	if string(data) != "synosystemctl reload nginx\nsynopkg restart VPNCenter\n" {
+		t.Errorf("Unexpected reload commands: %q", string(data))
+	}
+
+	info, err := readSynologyInfo(filepath.Join(root, synologyCertDir, "_archive"))
+	if err != nil || len(info) != 1 || info["AbC123"].UserDeletable == nil || len(info["AbC123"].Services) != 2 {
+		t.Errorf("Expected archive entry to be kept, got %+v (%v)", info, err)
+	}
+
+	// Fields DSM adds are written back unchanged
+	raw, _ := os.ReadFile(filepath.Join(root, synologyCertDir, "_archive", "INFO"))
+	for _, field := range []string{`"display_name_i18n":"common:web_desktop"`, `"multiple_cert":true`, `"user_setable":true`, `"is_broken":false`} {
+		if !strings.Contains(string(raw), field) {
+			t.Errorf("Expected %s to be kept in INFO, got %s", field, string(raw))
+		}
+	}
+}
+
+func TestSynologyReloadHooks(t *testing.T) {
+	root, _ := newFakeSynology(t)
+	reloads, err := parseSynologyReloads([]string{"smbftpd=/usr/syno/bin/synosystemctl restart ftpd"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := parseSynologyReloads([]string{"restart ftpd"}); err == nil {
+		t.Error("Expected an error for an entry without subscriber")
+	}
+
+	hooks, unknown := synologyReloadHooks(root, []synologyService{
+		{Subscriber: "system", Service: "default"},
+		{Subscriber: "ReverseProxy", Service: "proxy"},
+		{Subscriber: "smbftpd", Service: "ftpd"},
+		{Subscriber: "VPNCenter", Service: "OpenVPN", IsPkg: true},
+		{Subscriber: "directoryserver", Service: "ldap"},
+	}, reloads)
+
+	var commands []string
+	for _, hook := range hooks {
+		commands = append(commands, strings.TrimPrefix(hook.String(), root+"/"))
+	}
+	want := "usr/syno/bin/synosystemctl reload nginx; /usr/syno/bin/synosystemctl restart ftpd; usr/syno/bin/synopkg restart VPNCenter"
+	if got := strings.Join(commands, "; "); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if len(unknown) != 1 || unknown[0] != "directoryserver" {
+		t.Errorf("Expected directoryserver to be reported, got %v", unknown)
+	}
+}
+
+func TestDeploySynologyCertificateNewEntry(t *testing.T) {
+	root, _ := newFakeSynology(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	files := map[string][]byte{
+		"proxy.cer": newTestCertificate(t, key, []string{"proxy.example.com"}, time.Now().Add(90*24*time.Hour)),
+		"proxy.key": []byte("KEY"),
+	}
+
+	cert := CertificateConfig{Name: "proxy", SynologyRoot: root, SynologyDesc: "proxy", SynologyDefault: true, HookTimeout: 10 * time.Second}
+	if err := deploySynologyCertificate(cert, files); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	archive := filepath.Join(root, synologyCertDir, "_archive")
+	info, _ := readSynologyInfo(archive)
+	id := synologyArchiveID(info, "proxy")
+	if len(info) != 2 || len(id) != 6 {
+		t.Fatalf("Expected new archive entry, got %+v", info)
+	}
+	if data, _ := os.ReadFile(filepath.Join(archive, "DEFAULT")); string(data) != id {
+		t.Errorf("Expected %s to become the default certificate, got %s", id, string(data))
+	}
+	if _, err := os.Stat(filepath.Join(archive, id, "fullchain.pem")); err != nil {
+		t.Errorf("Expected certificate in archive: %v", err)
+	}
+
+	raw, _ := os.ReadFile(filepath.Join(archive, "INFO"))
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &entries); err != nil || !strings.Contains(string(entries[id]), `"services":[]`) {
+		t.Errorf("Expected empty service list for new entry, got %s", string(raw))
+	}
+}
+
+func TestDeploySynologyFailureAfterInstall(t *testing.T) {
+	root, _ := newFakeSynology(t)
+	os.WriteFile(filepath.Join(root, synologyCertDir, "_archive", "INFO"), []byte("{broken"), 0600)
+
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "hook.out")
+	cert := CertificateConfig{
+		Name:         "nas",
+		Domains:      []string{"nas.example.com"},
+		Path:         dir,
+		Deploy:       []string{deployFiles, deploySynology},
+		SynologyRoot: root,
+		SynologyDesc: "nas",
+		PostDeploy:   `sh -c 'echo reloaded >> ` + out + `'`,
+		HookTimeout:  10 * time.Second,
+	}
+	files := testFiles(t, "nas")
+
+	err := deployCertificate(cert, files)
+	if !errors.Is(err, errCertificateInstalled) || !strings.Contains(err.Error(), "synology") {
+		t.Fatalf("Expected the synology failure after installing, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "nas.cer")); string(data) != string(files["nas.cer"]) {
+		t.Error("Expected the certificate to be installed")
+	}
+	if data, _ := os.ReadFile(out); string(data) != "reloaded\n" {
+		t.Errorf("Expected the post-deploy hook to run, got %q", string(data))
+	}
+}
@@ -0,0 +1,347 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tlsaData is a TLSA record as stored by Cloudflare
+type tlsaData struct {
+	Usage        int    `json:"usage"`
+	Selector     int    `json:"selector"`
+	MatchingType int    `json:"matching_type"`
+	Certificate  string `json:"certificate"`
+}
+
+// tlsaRecord is a TLSA record at a name such as _25._tcp.mail.example.com
+type tlsaRecord struct {
+	Name string `json:"name"`
+	tlsaData
+}
+
+// tlsaPending is a replaced TLSA record waiting to be removed
+type tlsaPending struct {
+	tlsaRecord
+	RemoveAfter time.Time `json:"remove_after"`
+}
+
+func (r tlsaRecord) String() string {
+	return fmt.Sprintf("%s TLSA %d %d %d %s", r.Name, r.Usage, r.Selector, r.MatchingType, r.Certificate)
+}
+
+// parseTLSANames returns the TLSA record names for entries of the form [host:]port[/proto].
+// Entries without a host apply to every non-wildcard domain of the certificate.
+func parseTLSANames(values, domains []string) ([]string, error) {
+	var names []string
+	for _, value := range values {
+		host, port, found := strings.Cut(value, ":")
+		if !found {
+			host, port = "", value
+		}
+		port, proto, found := strings.Cut(port, "/")
+		if !found {
+			proto = "tcp"
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid TLSA port in %q", value)
+		}
+		if proto != "tcp" && proto != "udp" && proto != "sctp" {
+			return nil, fmt.Errorf("invalid TLSA protocol in %q", value)
+		}
+
+		hosts := []string{host}
+		if host == "" {
+			hosts = nil
+			for _, domain := range domains {
+				if !strings.HasPrefix(domain, "*.") {
+					hosts = append(hosts, domain)
+				}
+			}
+		}
+		for _, host := range hosts {
+			names = append(names, fmt.Sprintf("_%s._%s.%s", port, proto, strings.ToLower(host)))
+		}
+	}
+	return names, nil
+}
+
+// parseTLSAUsages parses the certificate usages to publish, 3 (DANE-EE) and/or 2 (DANE-TA)
+func parseTLSAUsages(values []string) ([]int, error) {
+	var usages []int
+	for _, value := range values {
+		usage, err := strconv.Atoi(value)
+		if err != nil || (usage != 2 && usage != 3) {
+			return nil, fmt.Errorf("invalid TLSA usage %q, expected 2 or 3", value)
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// tlsaRecords returns the "3 1 1" and "2 1 1" records of all variants in files.
+// Usage 3 matches the public key of the certificate, usage 2 the one of its issuer.
+func tlsaRecords(cert CertificateConfig, files map[string][]byte) ([]tlsaRecord, error) {
+	var records []tlsaRecord
+	seen := map[tlsaRecord]bool{}
+	for _, variant := range cert.variants() {
+		chain, err := variantChain(cert, files, variant.Suffix)
+		if err != nil {
+			return nil, err
+		}
+		if chain == nil {
+			return nil, fmt.Errorf("TLSA records need the cert or fullchain output")
+		}
+
+		for _, usage := range cert.TLSAUsages {
+			spki := chain[0].RawSubjectPublicKeyInfo
+			if usage == 2 {
+				if len(chain) < 2 {
+					return nil, fmt.Errorf("TLSA usage 2 needs the chain or fullchain output")
+				}
+				spki = chain[1].RawSubjectPublicKeyInfo
+			}
+			sum := sha256.Sum256(spki)
+
+			for _, name := range cert.TLSA {
+				record := tlsaRecord{Name: name, tlsaData: tlsaData{Usage: usage, Selector: 1, MatchingType: 1, Certificate: hex.EncodeToString(sum[:])}}
+				if !seen[record] {
+					seen[record] = true
+					records = append(records, record)
+				}
+			}
+		}
+	}
+	return records, nil
+}
+
+// managedTLSA reports whether an existing record is one kind of record published for cert
+func (c CertificateConfig) managedTLSA(data tlsaData) bool {
+	if data.Selector != 1 || data.MatchingType != 1 {
+		return false
+	}
+	for _, usage := range c.TLSAUsages {
+		if data.Usage == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// cloudflareAutoTTL is the TTL Cloudflare uses for records with the automatic TTL 1
+const cloudflareAutoTTL = 300 * time.Second
+
+// existingTLSA returns the TLSA records at name with their record IDs and the
+// largest TTL among them
+func existingTLSA(client *cloudflareClient, name string) (string, map[string]tlsaData, time.Duration, error) {
+	zoneID, err := client.zoneID(name)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	records, err := client.records(zoneID, "TLSA", name)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	existing := map[string]tlsaData{}
+	var ttl time.Duration
+	for _, record := range records {
+		var data tlsaData
+		if err := json.Unmarshal(record.Data, &data); err != nil {
+			return "", nil, 0, fmt.Errorf("failed to parse TLSA record %s: %v", name, err)
+		}
+		data.Certificate = strings.ToLower(data.Certificate)
+		existing[record.ID] = data
+		ttl = max(ttl, recordTTL(record.TTL))
+	}
+	return zoneID, existing, ttl, nil
+}
+
+// recordTTL converts the TTL of a Cloudflare record
+func recordTTL(seconds int) time.Duration {
+	if seconds <= 1 {
+		return cloudflareAutoTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// publishTLSA adds the TLSA records of the new certificate next to the existing ones,
+// so clients keep validating the old certificate until it is replaced. It returns
+// how long to wait before the certificate is installed: twice the largest TTL of
+// the record sets that changed, so cached copies without the new records expire,
+// or at least cert.TLSAWait. Nothing needs to be waited for when no record changed.
+func publishTLSA(cert CertificateConfig, files map[string][]byte) ([]tlsaRecord, time.Duration, error) {
+	records, err := tlsaRecords(cert, files)
+	if err != nil {
+		return nil, 0, err
+	}
+	client, err := newCloudflareClient()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var wait time.Duration
+	for _, record := range records {
+		zoneID, existing, ttl, err := existingTLSA(client, record.Name)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		found := false
+		for _, data := range existing {
+			if data == record.tlsaData {
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+
+		data, err := json.Marshal(record.tlsaData)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := client.createRecord(zoneID, cloudflareRecord{Type: "TLSA", Name: record.Name, Data: data, TTL: 1}); err != nil {
+			return nil, 0, err
+		}
+		fmt.Printf("[%s] Published %s\n", cert.Name, record)
+		wait = max(wait, 2*max(ttl, cloudflareAutoTTL), cert.TLSAWait)
+	}
+	return records, wait, nil
+}
+
+// retireTLSA schedules the removal of the records replaced by records after
+// cert.TLSADelay and removes the ones that are due
+func retireTLSA(cert CertificateConfig, records []tlsaRecord, now time.Time) error {
+	client, err := newCloudflareClient()
+	if err != nil {
+		return err
+	}
+
+	pending, err := loadTLSAPending(cert.TLSAStateFile)
+	if err != nil {
+		return err
+	}
+
+	current := map[tlsaRecord]bool{}
+	for _, record := range records {
+		current[record] = true
+	}
+	scheduled := map[tlsaRecord]bool{}
+	var kept []tlsaPending
+	for _, p := range pending {
+		if !current[p.tlsaRecord] {
+			kept = append(kept, p)
+			scheduled[p.tlsaRecord] = true
+		}
+	}
+	pending = kept
+
+	for _, name := range cert.TLSA {
+		_, existing, _, err := existingTLSA(client, name)
+		if err != nil {
+			return err
+		}
+		for _, data := range existing {
+			record := tlsaRecord{Name: name, tlsaData: data}
+			if current[record] || scheduled[record] || !cert.managedTLSA(data) {
+				continue
+			}
+			scheduled[record] = true
+			pending = append(pending, tlsaPending{tlsaRecord: record, RemoveAfter: now.Add(cert.TLSADelay)})
+		}
+	}
+
+	if err := saveTLSAPending(cert.TLSAStateFile, pending); err != nil {
+		return err
+	}
+	return removeDueTLSA(cert, now)
+}
+
+// removeDueTLSA removes the replaced TLSA records whose delay has passed
+func removeDueTLSA(cert CertificateConfig, now time.Time) error {
+	pending, err := loadTLSAPending(cert.TLSAStateFile)
+	if err != nil {
+		return err
+	}
+
+	var due, kept []tlsaPending
+	for _, p := range pending {
+		if now.Before(p.RemoveAfter) {
+			kept = append(kept, p)
+		} else {
+			due = append(due, p)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	client, err := newCloudflareClient()
+	if err != nil {
+		return err
+	}
+	for i, p := range due {
+		zoneID, existing, _, err := existingTLSA(client, p.Name)
+		if err == nil {
+			for id, data := range existing {
+				if data == p.tlsaData {
+					if err = client.deleteRecord(zoneID, id); err != nil {
+						break
+					}
+				}
+			}
+		}
+		if err != nil {
+			saveTLSAPending(cert.TLSAStateFile, append(kept, due[i:]...))
+			return err
+		}
+		fmt.Printf("[%s] Removed %s\n", cert.Name, p.tlsaRecord)
+	}
+	return saveTLSAPending(cert.TLSAStateFile, kept)
+}
+
+// loadTLSAPending reads the TLSA records waiting for removal
+func loadTLSAPending(path string) ([]tlsaPending, error) {
+	var pending []tlsaPending
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return pending, nil
+}
+
+// saveTLSAPending writes the TLSA records waiting for removal
+func saveTLSAPending(path string, pending []tlsaPending) error {
+	if len(pending) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
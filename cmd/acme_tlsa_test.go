@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+func TestParseTLSANames(t *testing.T) {
+	names, err := parseTLSANames([]string{"25", "xmpp.example.com:5269/tcp", "853/udp"}, []string{"mail.example.com", "*.example.com"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"_25._tcp.mail.example.com", "_5269._tcp.xmpp.example.com", "_853._udp.mail.example.com"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+
+	for _, value := range []string{"smtp", "mail.example.com:0", "25/icmp"} {
+		if _, err := parseTLSANames([]string{value}, nil); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+	if _, err := parseTLSAUsages([]string{"1"}); err == nil {
+		t.Error("Expected error for usage 1")
+	}
+}
+
+func TestTLSARecords(t *testing.T) {
+	files := testFiles(t, "mail")
+	cert := CertificateConfig{Name: "mail", TLSA: []string{"_25._tcp.mail.example.com"}, TLSAUsages: []int{3, 2}}
+
+	records, err := tlsaRecords(cert, files)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	leaf, _ := certcrypto.ParsePEMCertificate(files["mail.cer"])
+	issuer, _ := certcrypto.ParsePEMCertificate(files["ca.cer"])
+	leafSum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	issuerSum := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	expected := []tlsaRecord{
+		{Name: "_25._tcp.mail.example.com", tlsaData: tlsaData{Usage: 3, Selector: 1, MatchingType: 1, Certificate: hex.EncodeToString(leafSum[:])}},
+		{Name: "_25._tcp.mail.example.com", tlsaData: tlsaData{Usage: 2, Selector: 1, MatchingType: 1, Certificate: hex.EncodeToString(issuerSum[:])}},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected %v, got %v", expected, records)
+	}
+}
+
+func TestTLSARollover(t *testing.T) {
+	fake := newFakeCloudflare(t)
+	name := "_25._tcp.mail.example.com"
+	cert := CertificateConfig{
+		Name:          "mail",
+		TLSA:          []string{name},
+		TLSAUsages:    []int{3},
+		TLSADelay:     time.Hour,
+		TLSAStateFile: filepath.Join(t.TempDir(), "tlsa", "mail.json"),
+	}
+
+	// A foreign record with another usage is left alone
+	foreign, _ := json.Marshal(tlsaData{Usage: 1, Selector: 0, MatchingType: 1, Certificate: "abcd"})
+	fake.records = append(fake.records, cloudflareRecord{ID: "foreign", Type: "TLSA", Name: name, Data: foreign})
+
+	files := testFiles(t, "mail")
+	old, wait, err := publishTLSA(cert, files)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if wait != 2*cloudflareAutoTTL {
+		t.Errorf("Expected to wait twice the automatic TTL, got %s", wait)
+	}
+	if _, wait, _ := publishTLSA(cert, files); wait != 0 {
+		t.Errorf("Expected no wait when the records exist, got %s", wait)
+	}
+	now := time.Now()
+	if err := retireTLSA(cert, old, now); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cert.TLSAWait = time.Hour
+	current, wait, err := publishTLSA(cert, testFiles(t, "mail"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if wait != time.Hour {
+		t.Errorf("Expected the configured wait, got %s", wait)
+	}
+	if len(fake.records) != 3 {
+		t.Fatalf("Expected old and new record next to the foreign one, got %d records", len(fake.records))
+	}
+
+	if err := retireTLSA(cert, current, now); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pending, _ := loadTLSAPending(cert.TLSAStateFile)
+	if len(pending) != 1 || pending[0].tlsaRecord != old[0] || !pending[0].RemoveAfter.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected the old record to be scheduled for removal, got %+v", pending)
+	}
+	if len(fake.records) != 3 {
+		t.Errorf("Expected old record to stay until the delay passed, got %d records", len(fake.records))
+	}
+
+	if err := removeDueTLSA(cert, now.Add(2*time.Hour)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(fake.records) != 2 || fake.records[0].ID != "foreign" {
+		t.Errorf("Expected the old record to be removed, got %+v", fake.records)
+	}
+	var data tlsaData
+	json.Unmarshal(fake.records[1].Data, &data)
+	if data != current[0].tlsaData {
+		t.Errorf("Expected the current record to remain, got %+v", data)
+	}
+	if pending, _ := loadTLSAPending(cert.TLSAStateFile); len(pending) != 0 {
+		t.Errorf("Expected no pending records, got %+v", pending)
+	}
+}
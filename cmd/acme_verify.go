@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// verifyInterval is the pause between verification attempts while a service restarts
+const verifyInterval = 2 * time.Second
+
+// deployVerification checks a deploy target after the post-deploy hooks ran
+type deployVerification struct {
+	// Addresses are local host:port endpoints that must serve the new certificate
+	Addresses []string
+	// URL is requested and must answer with a status below 400
+	URL string
+}
+
+// getVerifications reads the verification of every deploy target of cert from
+// <prefix>VERIFY_<TARGET> and <prefix>VERIFY_<TARGET>_URL
+func getVerifications(cert *CertificateConfig, prefix string) error {
+	for _, target := range cert.Deploy {
+		key := prefix + "VERIFY_" + envName(target)
+		verification := deployVerification{Addresses: getEnvList(key), URL: getEnv(key+"_URL", "")}
+		for _, address := range verification.Addresses {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return fmt.Errorf("certificate %s: invalid verify address %q for %s", cert.Name, address, target)
+			}
+		}
+		if verification.URL != "" {
+			if u, err := url.Parse(verification.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("certificate %s: invalid verify URL %q for %s", cert.Name, verification.URL, target)
+			}
+		}
+		if len(verification.Addresses) > 0 || verification.URL != "" {
+			if cert.Verify == nil {
+				cert.Verify = map[string]deployVerification{}
+			}
+			cert.Verify[target] = verification
+		}
+	}
+	return nil
+}
+
+// verifyServerName returns the name sent with SNI when verifying cert
+func (c CertificateConfig) verifyServerName() string {
+	if c.VerifyServerName != "" {
+		return c.VerifyServerName
+	}
+	for _, domain := range c.Domains {
+		if !strings.HasPrefix(domain, "*.") {
+			return domain
+		}
+	}
+	if len(c.Domains) > 0 {
+		return strings.TrimPrefix(c.Domains[0], "*.")
+	}
+	return ""
+}
+
+// verifyDeployment checks every deploy target until it serves one of the new
+// certificates in files or cert.VerifyTimeout has passed
+func verifyDeployment(cert CertificateConfig, files map[string][]byte) error {
+	var serials []*big.Int
+	for _, variant := range cert.variants() {
+		chain, err := variantChain(cert, files, variant.Suffix)
+		if err != nil || chain == nil {
+			return fmt.Errorf("failed to read the new certificate: %v", err)
+		}
+		serials = append(serials, chain[0].SerialNumber)
+	}
+
+	targets := make([]string, 0, len(cert.Verify))
+	for target := range cert.Verify {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	deadline := time.Now().Add(cert.VerifyTimeout)
+	for _, target := range targets {
+		for {
+			err := verifyTarget(cert, cert.Verify[target], serials)
+			if err == nil {
+				fmt.Printf("[%s] Verified %s deployment\n", cert.Name, target)
+				break
+			}
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return fmt.Errorf("%s: %v", target, err)
+			}
+			time.Sleep(min(wait, verifyInterval))
+		}
+	}
+	return nil
+}
+
+// verifyTarget checks that the addresses of a target serve one of the serials
+// and that its health URL answers
+func verifyTarget(cert CertificateConfig, verification deployVerification, serials []*big.Int) error {
+	serverName := cert.verifyServerName()
+	for _, address := range verification.Addresses {
+		_, port, _ := net.SplitHostPort(address)
+		chain, err := fetchServedChain(address, serverName, defaultStartTLS(port), 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("%s: %v", address, err)
+		}
+
+		served := false
+		for _, serial := range serials {
+			if chain[0].SerialNumber.Cmp(serial) == 0 {
+				served = true
+			}
+		}
+		if !served {
+			return fmt.Errorf("%s serves serial %x instead of the new certificate", address, chain[0].SerialNumber)
+		}
+	}
+
+	if verification.URL != "" {
+		// The served certificate was checked above, local health URLs rarely match its names
+		client := &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		}
+		resp, err := client.Get(verification.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%s returned %s", verification.URL, resp.Status)
+		}
+	}
+	return nil
+}
+
+// rollbackDeployment restores the backup taken before a deployment whose verification failed
+func rollbackDeployment(cert CertificateConfig, backupPath string, cause error) error {
+	if backupPath == "" {
+		return fmt.Errorf("verification failed: %v (no previous certificate to restore)", cause)
+	}
+
+	fmt.Printf("[%s] Verification failed, restoring the previous certificate: %v\n", cert.Name, cause)
+	if err := restoreBackup(cert, filepath.Base(backupPath)); err != nil {
+		// The files are back even when a deploy hook fails again
+		if errors.Is(err, errCertificateInstalled) {
+			return fmt.Errorf("verification failed, previous certificate restored: %v; %v", cause, err)
+		}
+		return fmt.Errorf("verification failed: %v; restoring the previous certificate failed: %v", cause, err)
+	}
+	return fmt.Errorf("verification failed, previous certificate restored: %v", cause)
+}
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// testService is a TLS server whose certificate and health status can be changed
+type testService struct {
+	mu     sync.Mutex
+	pair   tls.Certificate
+	status int
+	server *httptest.Server
+}
+
+func newTestService(t *testing.T, files map[string][]byte) *testService {
+	t.Helper()
+
+	service := &testService{status: http.StatusOK}
+	service.serve(t, files)
+	service.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service.mu.Lock()
+		defer service.mu.Unlock()
+		w.WriteHeader(service.status)
+	}))
+	service.server.TLS = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		service.mu.Lock()
+		defer service.mu.Unlock()
+		return &service.pair, nil
+	}}
+	service.server.StartTLS()
+	t.Cleanup(service.server.Close)
+	return service
+}
+
+// serve switches the served certificate to the one in files
+func (s *testService) serve(t *testing.T, files map[string][]byte) {
+	pair, err := tls.X509KeyPair(files["fullchain.pem"], files["nas.key"])
+	if err != nil {
+		t.Fatalf("Failed to load key pair: %v", err)
+	}
+	s.mu.Lock()
+	s.pair = pair
+	s.mu.Unlock()
+}
+
+func TestVerifyDeploymentRollback(t *testing.T) {
+	old := testFiles(t, "nas")
+	service := newTestService(t, old)
+
+	dir := t.TempDir()
+	cert := CertificateConfig{
+		Name:          "nas",
+		Domains:       []string{"nas.example.com"},
+		Path:          dir,
+		Deploy:        []string{deployFiles},
+		BackupDir:     filepath.Join(t.TempDir(), "backups"),
+		Backups:       5,
+		VerifyTimeout: 100 * time.Millisecond,
+	}
+	if err := deployCertificate(cert, old); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cert.Verify = map[string]deployVerification{deployFiles: {
+		Addresses: []string{service.server.Listener.Addr().String()},
+		URL:       service.server.URL + "/health",
+	}}
+
+	// The service keeps serving the old certificate
+	replacement := testFiles(t, "nas")
+	err := deployCertificate(cert, replacement)
+	if err == nil || !strings.Contains(err.Error(), "previous certificate restored") || !strings.Contains(err.Error(), "instead of the new certificate") {
+		t.Fatalf("Expected verification failure with rollback, got %v", err)
+	}
+	if installed, _ := os.ReadFile(filepath.Join(dir, "nas.cer")); !bytes.Equal(installed, old["nas.cer"]) {
+		t.Error("Expected the previous certificate to be restored")
+	}
+	if backups, _ := listBackups(cert); len(backups) != 0 {
+		t.Errorf("Expected the restored backup to be removed, got %v", backups)
+	}
+
+	// The service picks up the new certificate but is unhealthy
+	service.serve(t, replacement)
+	service.status = http.StatusBadGateway
+	if err := deployCertificate(cert, replacement); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("Expected health check failure, got %v", err)
+	}
+	if installed, _ := os.ReadFile(filepath.Join(dir, "nas.cer")); !bytes.Equal(installed, old["nas.cer"]) {
+		t.Error("Expected the previous certificate to be restored")
+	}
+
+	service.status = http.StatusOK
+	if err := deployCertificate(cert, replacement); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	installed, _ := os.ReadFile(filepath.Join(dir, "nas.cer"))
+	if leaf, _ := certcrypto.ParsePEMCertificate(installed); !bytes.Equal(installed, replacement["nas.cer"]) || leaf == nil {
+		t.Error("Expected the new certificate to stay installed")
+	}
+}
+
+func TestVerifyAfterFailedPostDeploy(t *testing.T) {
+	old := testFiles(t, "nas")
+	service := newTestService(t, old)
+
+	dir := t.TempDir()
+	cert := CertificateConfig{
+		Name:          "nas",
+		Domains:       []string{"nas.example.com"},
+		Path:          dir,
+		Deploy:        []string{deployFiles},
+		BackupDir:     filepath.Join(t.TempDir(), "backups"),
+		Backups:       5,
+		HookTimeout:   10 * time.Second,
+		VerifyTimeout: 100 * time.Millisecond,
+	}
+	if err := deployCertificate(cert, old); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The reload fails and the service keeps the old certificate
+	cert.PostDeploy = "false"
+	cert.Verify = map[string]deployVerification{deployFiles: {Addresses: []string{service.server.Listener.Addr().String()}}}
+	err := deployCertificate(cert, testFiles(t, "nas"))
+	if err == nil || !strings.Contains(err.Error(), "previous certificate restored") || !strings.Contains(err.Error(), "post-deploy") {
+		t.Fatalf("Expected the post-deploy failure and a rollback, got %v", err)
+	}
+	if installed, _ := os.ReadFile(filepath.Join(dir, "nas.cer")); !bytes.Equal(installed, old["nas.cer"]) {
+		t.Error("Expected the previous certificate to be restored")
+	}
+}
+
+func TestVerifyFirstDeployment(t *testing.T) {
+	cert := CertificateConfig{
+		Name:          "nas",
+		Domains:       []string{"nas.example.com"},
+		Path:          t.TempDir(),
+		Deploy:        []string{deployFiles},
+		BackupDir:     filepath.Join(t.TempDir(), "backups"),
+		Verify:        map[string]deployVerification{deployFiles: {Addresses: []string{"127.0.0.1:1"}}},
+		VerifyTimeout: 0,
+	}
+	err := deployCertificate(cert, testFiles(t, "nas"))
+	if err == nil || !strings.Contains(err.Error(), "no previous certificate") {
+		t.Errorf("Expected verification failure without rollback, got %v", err)
+	}
+}
+
+func TestGetCertificatesVerify(t *testing.T) {
+	os.Setenv("ACME_CERTIFICATES", "web")
+	os.Setenv("ACME_CERT_WEB_DOMAINS", "*.nas.example.com")
+	os.Setenv("ACME_CERT_WEB_PATH", "/tmp/dsm")
+	os.Setenv("ACME_CERT_WEB_DEPLOY", "files,synology")
+	os.Setenv("ACME_CERT_WEB_VERIFY_SYNOLOGY", "localhost:5001")
+	os.Setenv("ACME_CERT_WEB_VERIFY_SYNOLOGY_URL", "https://localhost:5001/")
+	defer func() {
+		for _, key := range []string{"ACME_CERTIFICATES", "ACME_CERT_WEB_DOMAINS", "ACME_CERT_WEB_PATH", "ACME_CERT_WEB_DEPLOY",
+			"ACME_CERT_WEB_VERIFY_SYNOLOGY", "ACME_CERT_WEB_VERIFY_SYNOLOGY_URL"} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	certs, err := getCertificates(AcmeConfig{KeyType: certcrypto.EC256, VerifyTimeout: time.Minute})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	verification, ok := certs[0].Verify[deploySynology]
+	if !ok || len(certs[0].Verify) != 1 || verification.Addresses[0] != "localhost:5001" || verification.URL != "https://localhost:5001/" {
+		t.Errorf("Unexpected verification: %+v", certs[0].Verify)
+	}
+	if certs[0].VerifyTimeout != time.Minute || certs[0].verifyServerName() != "nas.example.com" {
+		t.Errorf("Unexpected verification settings: %+v", certs[0])
+	}
+
+	os.Setenv("ACME_CERT_WEB_VERIFY_SYNOLOGY", "localhost")
+	if _, err := getCertificates(AcmeConfig{KeyType: certcrypto.EC256}); err == nil {
+		t.Error("Expected error for address without port")
+	}
+}
@@ -0,0 +1,388 @@
+package cmd
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/spf13/cobra"
+)
+
+var (
+	caRootKeyFile  string
+	caRenewForce   bool
+	caRevokeReason string
+)
+
+// CaConfig holds the settings of the private CA
+type CaConfig struct {
+	Dir              string
+	Name             string
+	KeyType          certcrypto.KeyType
+	CertKeyType      certcrypto.KeyType
+	RootKey          string
+	RootDays         int
+	IntermediateDays int
+	CertDays         int
+	CRLDays          int
+	CRLURL           string
+	CRLPath          string
+}
+
+// caCertificate is a certificate issued by the private CA
+type caCertificate struct {
+	CertificateConfig
+	Type string
+	Days int
+}
+
+func getCaConfig() CaConfig {
+	dir := getEnv("CA_DIR", filepath.Join(os.Getenv("HOME"), ".nas-manager", "ca"))
+	return CaConfig{
+		Dir:              dir,
+		Name:             getEnv("CA_NAME", "nas-manager"),
+		KeyType:          envKeyType("CA_KEY_TYPE", certcrypto.EC384),
+		CertKeyType:      envKeyType("CA_CERT_KEY_TYPE", certcrypto.EC256),
+		RootKey:          getEnv("CA_ROOT_KEY", filepath.Join(dir, caRootKey)),
+		RootDays:         getEnvInt("CA_ROOT_DAYS", 3650),
+		IntermediateDays: getEnvInt("CA_INTERMEDIATE_DAYS", 1825),
+		CertDays:         getEnvInt("CA_CERT_DAYS", 90),
+		CRLDays:          getEnvInt("CA_CRL_DAYS", 7),
+		CRLURL:           getEnv("CA_CRL_URL", ""),
+		CRLPath:          getEnv("CA_CRL_PATH", ""),
+	}
+}
+
+// getCACertificates reads the certificates listed in CA_CERTIFICATES, each configured
+// with CA_CERT_<NAME>_* variables. Deployment settings fall back to the ACME defaults.
+func getCACertificates(config CaConfig) ([]caCertificate, error) {
+	acmeConfig := getAcmeConfig()
+
+	var certs []caCertificate
+	seen := map[string]bool{}
+	for _, name := range getEnvList("CA_CERTIFICATES") {
+		if seen[name] {
+			return nil, fmt.Errorf("certificate %s is defined twice", name)
+		}
+		seen[name] = true
+
+		prefix := "CA_CERT_" + envName(name) + "_"
+		cert := caCertificate{
+			CertificateConfig: CertificateConfig{
+				Name:     name,
+				Domains:  getEnvList(prefix + "DOMAINS"),
+				KeyType:  envKeyType(prefix+"KEY_TYPE", config.CertKeyType),
+				Path:     getEnv(prefix+"PATH", ""),
+				ReuseKey: getEnvBool(prefix+"REUSE_KEY", false),
+				KeyFile:  getEnv(prefix+"KEY_FILE", ""),
+			},
+			Type: strings.ToLower(getEnv(prefix+"TYPE", caTypeServer)),
+			Days: getEnvInt(prefix+"DAYS", config.CertDays),
+		}
+
+		if len(cert.Domains) == 0 {
+			return nil, fmt.Errorf("certificate %s: %sDOMAINS is required", name, prefix)
+		}
+		if cert.Path == "" {
+			return nil, fmt.Errorf("certificate %s: %sPATH is required", name, prefix)
+		}
+		if cert.Type != caTypeServer && cert.Type != caTypeClient {
+			return nil, fmt.Errorf("certificate %s: unknown type %q (use server or client)", name, cert.Type)
+		}
+		if cert.Days < 1 {
+			return nil, fmt.Errorf("certificate %s: %sDAYS must be positive", name, prefix)
+		}
+		if err := applyKeySource(&cert.CertificateConfig); err != nil {
+			return nil, err
+		}
+		if err := validateKeyTypes(cert.CertificateConfig); err != nil {
+			return nil, err
+		}
+		if err := setDeploySettings(&cert.CertificateConfig, acmeConfig, prefix, config.Dir); err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// requireCACertificates returns the CA and the selected certificates or exits
+// when the CA or the certificates are not configured
+func requireCACertificates(names []string) (*certificateAuthority, []caCertificate) {
+	ca, err := loadCA(getCaConfig())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	certs, err := getCACertificates(ca.config)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(certs) == 0 {
+		fmt.Println("Error: CA_CERTIFICATES is required")
+		os.Exit(1)
+	}
+
+	configs := make([]CertificateConfig, len(certs))
+	for i, cert := range certs {
+		configs[i] = cert.CertificateConfig
+	}
+	selected, err := selectCertificates(configs, names)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	result := make([]caCertificate, 0, len(selected))
+	for _, s := range selected {
+		for _, cert := range certs {
+			if cert.Name == s.Name {
+				result = append(result, cert)
+			}
+		}
+	}
+	return ca, result
+}
+
+// renewCACertificates issues the certificates that are due, or all with force
+func renewCACertificates(ca *certificateAuthority, certs []caCertificate, force bool) []certificateResult {
+	byName := map[string]caCertificate{}
+	configs := make([]CertificateConfig, len(certs))
+	for i, cert := range certs {
+		byName[cert.Name] = cert
+		configs[i] = cert.CertificateConfig
+	}
+
+	// Issuances are not run concurrently as they share the index
+	return renewCertificates(configs, force, 1, ca.schedule(), func(cert CertificateConfig) error {
+		return issueCACertificate(ca, byName[cert.Name])
+	})
+}
+
+// issueCACertificate signs a new certificate and deploys it like an ACME certificate
+func issueCACertificate(ca *certificateAuthority, cert caCertificate) error {
+	variant := certificateVariant{KeyType: cert.KeyType}
+	key, err := certificateKey(cert.CertificateConfig, variant)
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %v", err)
+	}
+	if key == nil {
+		if key, err = certcrypto.GeneratePrivateKey(cert.KeyType); err != nil {
+			return fmt.Errorf("failed to generate private key: %v", err)
+		}
+	}
+
+	leaf, err := ca.sign(cert.Name, cert.Type, cert.Domains, cert.Days, key.(crypto.Signer).Public())
+	if err != nil {
+		return fmt.Errorf("failed to sign certificate: %v", err)
+	}
+
+	files, err := certificateFiles(cert.CertificateConfig, &certificate.Resource{
+		Domain:            cert.Domains[0],
+		PrivateKey:        certcrypto.PEMEncode(key),
+		Certificate:       append(append([]byte{}, leaf...), ca.certPEM...),
+		IssuerCertificate: ca.certPEM,
+	})
+	if err != nil {
+		return err
+	}
+	return deployCertificate(cert.CertificateConfig, files)
+}
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Private certificate authority for internal services",
+	Long: `Run a private certificate authority for internal services and clients.
+
+The root is only needed to create intermediates and can be kept offline
+(CA_ROOT_KEY). Certificates are signed by the intermediate, recorded in
+CA_DIR/index.json and deployed with the deploy targets and hooks of acme.`,
+}
+
+var caInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create the root and the intermediate of the CA",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := getCaConfig()
+		if err := initCA(config); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		ca, err := loadCA(config)
+		if err == nil {
+			err = ca.publishCRL(time.Now())
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("CA created in %s\n", config.Dir)
+		fmt.Printf("Distribute %s to your clients and move %s to offline storage.\n",
+			filepath.Join(config.Dir, caRootCert), config.RootKey)
+	},
+}
+
+var caIntermediateCmd = &cobra.Command{
+	Use:   "intermediate",
+	Short: "Replace the intermediate with a new one signed by the root",
+	Long: `Replace the intermediate with a new one signed by the root. The certificate of
+the previous intermediate is kept in CA_DIR/retired. Certificates it signed are
+not covered by the CRL of the new intermediate, ca renew replaces them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		config := getCaConfig()
+		if caRootKeyFile != "" {
+			config.RootKey = caRootKeyFile
+		}
+		if err := renewIntermediate(config); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		ca, err := loadCA(config)
+		if err == nil {
+			err = ca.publishCRL(time.Now())
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Intermediate replaced, run ca renew to reissue the certificates with it.")
+	},
+}
+
+var caIssueCmd = &cobra.Command{
+	Use:   "issue [name...]",
+	Short: "Issue certificates from CA_CERTIFICATES",
+	Run: func(cmd *cobra.Command, args []string) {
+		ca, certs := requireCACertificates(args)
+		if printCertificateResults(os.Stdout, renewCACertificates(ca, certs, true)) {
+			os.Exit(1)
+		}
+	},
+}
+
+var caRenewCmd = &cobra.Command{
+	Use:   "renew [name...]",
+	Short: "Renew certificates that are due and refresh the CRL",
+	Run: func(cmd *cobra.Command, args []string) {
+		ca, certs := requireCACertificates(args)
+		failed := printCertificateResults(os.Stdout, renewCACertificates(ca, certs, caRenewForce))
+
+		now := time.Now()
+		due, err := ca.crlDue(now)
+		if err == nil && due {
+			err = ca.publishCRL(now)
+		}
+		if err != nil {
+			fmt.Printf("CRL update failed: %v\n", err)
+			failed = true
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+var caListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the issued certificates",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := getCaConfig()
+		index, err := loadCAIndex(config.Dir)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		current := ""
+		if intermediate, err := readInstalledCertificate(filepath.Join(config.Dir, caIntermediateCert)); err == nil {
+			current = fmt.Sprintf("%x", intermediate.SerialNumber)
+		}
+
+		entries := index.Certificates
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].NotBefore.Before(entries[j].NotBefore) })
+
+		now := time.Now()
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "SERIAL\tNAME\tTYPE\tNAMES\tEXPIRES\tSTATUS")
+		for _, entry := range entries {
+			status := "valid"
+			switch {
+			case !entry.RevokedAt.IsZero():
+				status = "revoked " + entry.RevokedAt.Format("2006-01-02")
+			case entry.NotAfter.Before(now):
+				status = "expired"
+			case entry.Issuer != "" && entry.Issuer != current:
+				status = "valid, retired intermediate"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Serial, entry.Name, entry.Type,
+				strings.Join(entry.Names, ","), entry.NotAfter.Format("2006-01-02"), status)
+		}
+		tw.Flush()
+	},
+}
+
+var caRevokeCmd = &cobra.Command{
+	Use:   "revoke <serial|name>",
+	Short: "Revoke a certificate and publish a new CRL",
+	Long: `Revoke the certificate with the given serial, or all valid certificates
+issued under a certificate name, and publish a new CRL.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		reason, err := parseRevocationReason(caRevokeReason)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		ca, err := loadCA(getCaConfig())
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		serials, err := ca.revoke(args[0], reason, time.Now())
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, serial := range serials {
+			fmt.Printf("Certificate %s revoked.\n", serial)
+		}
+	},
+}
+
+var caCRLCmd = &cobra.Command{
+	Use:   "crl",
+	Short: "Publish a new CRL",
+	Run: func(cmd *cobra.Command, args []string) {
+		ca, err := loadCA(getCaConfig())
+		if err == nil {
+			err = ca.publishCRL(time.Now())
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("CRL published to %s\n", filepath.Join(ca.config.Dir, caCRLFile))
+	},
+}
+
+func init() {
+	caIntermediateCmd.Flags().StringVar(&caRootKeyFile, "root-key", "", "Root private key (default CA_ROOT_KEY)")
+	caRenewCmd.Flags().BoolVar(&caRenewForce, "force", false, "Renew all certificates regardless of expiry")
+	caRevokeCmd.Flags().StringVar(&caRevokeReason, "reason", "unspecified", "Revocation reason (RFC 5280 code or name)")
+
+	caCmd.AddCommand(caInitCmd)
+	caCmd.AddCommand(caIntermediateCmd)
+	caCmd.AddCommand(caIssueCmd)
+	caCmd.AddCommand(caRenewCmd)
+	caCmd.AddCommand(caListCmd)
+	caCmd.AddCommand(caRevokeCmd)
+	caCmd.AddCommand(caCRLCmd)
+}
@@ -0,0 +1,430 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// Certificate types issued by the private CA
+const (
+	caTypeServer = "server"
+	caTypeClient = "client"
+)
+
+// Files of the private CA inside CA_DIR
+const (
+	caRootCert         = "root.crt"
+	caRootKey          = "root.key"
+	caIntermediateCert = "intermediate.crt"
+	caIntermediateKey  = "intermediate.key"
+	caIndexFile        = "index.json"
+	caCRLFile          = "crl.pem"
+	caCRLDERFile       = "crl.der"
+	caRetiredDir       = "retired"
+)
+
+// certificateAuthority is the intermediate of the private CA that signs certificates and CRLs
+type certificateAuthority struct {
+	config  CaConfig
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+}
+
+// caIndex records the certificates issued by the private CA
+type caIndex struct {
+	CRLNumber    int64          `json:"crl_number"`
+	CRLUpdated   time.Time      `json:"crl_updated,omitzero"`
+	Certificates []caIndexEntry `json:"certificates"`
+}
+
+// caIndexEntry is one issued certificate
+type caIndexEntry struct {
+	Serial    string    `json:"serial"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Names     []string  `json:"names"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Issuer    string    `json:"issuer,omitempty"`
+	RevokedAt time.Time `json:"revoked_at,omitzero"`
+	Reason    uint      `json:"reason,omitempty"`
+}
+
+// initCA creates the root and the intermediate of a new private CA
+func initCA(config CaConfig) error {
+	if _, err := os.Stat(filepath.Join(config.Dir, caRootCert)); err == nil {
+		return fmt.Errorf("CA already initialized in %s", config.Dir)
+	}
+	for _, dir := range []string{config.Dir, filepath.Dir(config.RootKey)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create CA directory: %v", err)
+		}
+	}
+
+	key, err := generateSigner(config.KeyType)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: config.Name + " Root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(0, 0, config.RootDays),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLen:            1,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := signCertificate(template, template, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("failed to create root: %v", err)
+	}
+	root, _ := x509.ParseCertificate(der)
+
+	if err := writeFileSync(config.RootKey, certcrypto.PEMEncode(key), 0600); err != nil {
+		return fmt.Errorf("failed to write root key: %v", err)
+	}
+	if err := writeFileSync(filepath.Join(config.Dir, caRootCert), pemCertificate(der), 0644); err != nil {
+		return fmt.Errorf("failed to write root: %v", err)
+	}
+	return createIntermediate(config, root, key)
+}
+
+// createIntermediate issues a new intermediate signed by the root. The certificate
+// of the intermediate it replaces is kept in CA_DIR/retired.
+func createIntermediate(config CaConfig, root *x509.Certificate, rootKey crypto.Signer) error {
+
+	key, err := generateSigner(config.KeyType)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: config.Name + " Intermediate"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              earliest(now.AddDate(0, 0, config.IntermediateDays), root.NotAfter),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := signCertificate(template, root, key.Public(), rootKey)
+	if err != nil {
+		return fmt.Errorf("failed to create intermediate: %v", err)
+	}
+
+	if err := retireIntermediate(config); err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(config.Dir, caIntermediateKey), certcrypto.PEMEncode(key), 0600); err != nil {
+		return fmt.Errorf("failed to write intermediate key: %v", err)
+	}
+	return writeFileSync(filepath.Join(config.Dir, caIntermediateCert), pemCertificate(der), 0644)
+}
+
+// retireIntermediate moves the current intermediate certificate to CA_DIR/retired,
+// named by its serial. Its key is not kept, nothing is signed with it anymore.
+func retireIntermediate(config CaConfig) error {
+	cert, err := readInstalledCertificate(filepath.Join(config.Dir, caIntermediateCert))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read intermediate: %v", err)
+	}
+	dir := filepath.Join(config.Dir, caRetiredDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	if err := os.Rename(filepath.Join(config.Dir, caIntermediateCert), filepath.Join(dir, fmt.Sprintf("%x.crt", cert.SerialNumber))); err != nil {
+		return fmt.Errorf("failed to retire intermediate: %v", err)
+	}
+	return nil
+}
+
+// renewIntermediate replaces the intermediate with one signed by the root key in config.RootKey
+func renewIntermediate(config CaConfig) error {
+	root, err := readInstalledCertificate(filepath.Join(config.Dir, caRootCert))
+	if err != nil {
+		return fmt.Errorf("failed to read root: %v", err)
+	}
+	rootKey, err := readPrivateKey(config.RootKey)
+	if err != nil {
+		return fmt.Errorf("failed to read root key: %v", err)
+	}
+	return createIntermediate(config, root, rootKey.(crypto.Signer))
+}
+
+// loadCA reads the intermediate of the private CA
+func loadCA(config CaConfig) (*certificateAuthority, error) {
+	certPEM, err := os.ReadFile(filepath.Join(config.Dir, caIntermediateCert))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no CA in %s, run ca init first", config.Dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert, err := certcrypto.ParsePEMCertificate(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse intermediate: %v", err)
+	}
+	key, err := readPrivateKey(filepath.Join(config.Dir, caIntermediateKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read intermediate key: %v", err)
+	}
+	return &certificateAuthority{config: config, cert: cert, certPEM: certPEM, key: key.(crypto.Signer)}, nil
+}
+
+// serial returns the serial of the intermediate as recorded in the index
+func (ca *certificateAuthority) serial() string {
+	return fmt.Sprintf("%x", ca.cert.SerialNumber)
+}
+
+// schedule renews certificates signed by a retired intermediate right away, as
+// the CRL of the current intermediate does not cover them. Other certificates are
+// renewed in their renewal window.
+func (ca *certificateAuthority) schedule() renewalSchedule {
+	return func(cert CertificateConfig, leaf *x509.Certificate, now time.Time) (time.Time, error) {
+		if err := leaf.CheckSignatureFrom(ca.cert); err != nil {
+			fmt.Printf("[%s] Signed by a retired intermediate\n", cert.Name)
+			return now, nil
+		}
+		return leaf.NotAfter.Add(-renewBefore(cert, leaf)), nil
+	}
+}
+
+// sign issues a certificate of certType for names and records it in the index
+func (ca *certificateAuthority) sign(name, certType string, names []string, days int, pub crypto.PublicKey) ([]byte, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no names to certify")
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: names[0]},
+		NotBefore: now.Add(-5 * time.Minute),
+		NotAfter:  earliest(now.AddDate(0, 0, days), ca.cert.NotAfter),
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+	}
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if certType == caTypeClient {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	if ca.config.CRLURL != "" {
+		template.CRLDistributionPoints = []string{ca.config.CRLURL}
+	}
+	for _, n := range names {
+		switch {
+		case net.ParseIP(n) != nil:
+			template.IPAddresses = append(template.IPAddresses, net.ParseIP(n))
+		case strings.Contains(n, "@"):
+			template.EmailAddresses = append(template.EmailAddresses, n)
+		default:
+			template.DNSNames = append(template.DNSNames, n)
+		}
+	}
+
+	der, err := signCertificate(template, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	index, err := loadCAIndex(ca.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	index.Certificates = append(index.Certificates, caIndexEntry{
+		Serial:    fmt.Sprintf("%x", cert.SerialNumber),
+		Name:      name,
+		Type:      certType,
+		Names:     names,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		Issuer:    ca.serial(),
+	})
+	if err := saveCAIndex(ca.config.Dir, index); err != nil {
+		return nil, err
+	}
+	return pemCertificate(der), nil
+}
+
+// revoke marks the certificate with the serial, or all valid certificates issued
+// under the name, as revoked and publishes a new CRL. It returns the revoked serials.
+func (ca *certificateAuthority) revoke(serialOrName string, reason uint, now time.Time) ([]string, error) {
+	index, err := loadCAIndex(ca.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var revoked []string
+	for i := range index.Certificates {
+		entry := &index.Certificates[i]
+		switch {
+		case strings.EqualFold(entry.Serial, serialOrName):
+			if !entry.RevokedAt.IsZero() {
+				return nil, fmt.Errorf("certificate %s is already revoked", entry.Serial)
+			}
+		case entry.Name == serialOrName:
+			if !entry.RevokedAt.IsZero() || entry.NotAfter.Before(now) {
+				continue
+			}
+		default:
+			continue
+		}
+		entry.RevokedAt, entry.Reason = now, reason
+		revoked = append(revoked, entry.Serial)
+		if entry.Issuer != "" && entry.Issuer != ca.serial() {
+			fmt.Printf("Warning: certificate %s was signed by the retired intermediate %s, the CRL does not cover it. Run ca renew to replace it.\n",
+				entry.Serial, entry.Issuer)
+		}
+	}
+	if len(revoked) == 0 {
+		return nil, fmt.Errorf("no valid certificate %s was issued by this CA", serialOrName)
+	}
+	if err := saveCAIndex(ca.config.Dir, index); err != nil {
+		return nil, err
+	}
+	return revoked, ca.publishCRL(now)
+}
+
+// publishCRL signs a CRL of all revoked certificates that have not expired yet
+// and writes it to CA_DIR and CA_CRL_PATH
+func (ca *certificateAuthority) publishCRL(now time.Time) error {
+	index, err := loadCAIndex(ca.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	var revoked []x509.RevocationListEntry
+	for _, entry := range index.Certificates {
+		if entry.RevokedAt.IsZero() || entry.NotAfter.Before(now) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(entry.Serial, 16)
+		if !ok {
+			return fmt.Errorf("invalid serial %q in index", entry.Serial)
+		}
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: entry.RevokedAt, ReasonCode: int(entry.Reason)})
+	}
+
+	index.CRLNumber++
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(index.CRLNumber),
+		ThisUpdate:                now,
+		NextUpdate:                now.AddDate(0, 0, ca.config.CRLDays),
+		RevokedCertificateEntries: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		return fmt.Errorf("failed to create CRL: %v", err)
+	}
+
+	if err := writeFileSync(filepath.Join(ca.config.Dir, caCRLFile), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(ca.config.Dir, caCRLDERFile), der, 0644); err != nil {
+		return err
+	}
+	if ca.config.CRLPath != "" {
+		if err := os.MkdirAll(filepath.Dir(ca.config.CRLPath), 0755); err != nil {
+			return err
+		}
+		if err := writeFileSync(ca.config.CRLPath, der, 0644); err != nil {
+			return fmt.Errorf("failed to publish CRL: %v", err)
+		}
+	}
+
+	index.CRLUpdated = now
+	return saveCAIndex(ca.config.Dir, index)
+}
+
+// crlDue reports whether half of the CRL lifetime has passed since it was published
+func (ca *certificateAuthority) crlDue(now time.Time) (bool, error) {
+	index, err := loadCAIndex(ca.config.Dir)
+	if err != nil {
+		return false, err
+	}
+	lifetime := time.Duration(ca.config.CRLDays) * 24 * time.Hour
+	return !now.Before(index.CRLUpdated.Add(lifetime / 2)), nil
+}
+
+// loadCAIndex reads the index of issued certificates
+func loadCAIndex(dir string) (caIndex, error) {
+	var index caIndex
+	data, err := os.ReadFile(filepath.Join(dir, caIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("failed to parse %s: %v", caIndexFile, err)
+	}
+	return index, nil
+}
+
+// saveCAIndex writes the index of issued certificates
+func saveCAIndex(dir string, index caIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, caIndexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, caIndexFile))
+}
+
+// signCertificate signs template with a random 128 bit serial number
+func signCertificate(template, parent *x509.Certificate, pub crypto.PublicKey, key crypto.Signer) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	return x509.CreateCertificate(rand.Reader, template, parent, pub, key)
+}
+
+// generateSigner creates a private key of keyType
+func generateSigner(keyType certcrypto.KeyType) (crypto.Signer, error) {
+	key, err := certcrypto.GeneratePrivateKey(keyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s key: %v", keyTypeName(keyType), err)
+	}
+	return key.(crypto.Signer), nil
+}
+
+// pemCertificate encodes a DER certificate as PEM
+func pemCertificate(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// earliest returns the earlier of two times
+func earliest(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
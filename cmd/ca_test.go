@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA creates a CA in a temporary directory with one server certificate "web"
+func testCA(t *testing.T) (*certificateAuthority, []caCertificate) {
+	t.Helper()
+
+	dir := t.TempDir()
+	env := map[string]string{
+		"CA_DIR":               filepath.Join(dir, "ca"),
+		"CA_NAME":              "Test",
+		"CA_CRL_URL":           "http://ca.example.com/crl.der",
+		"CA_CERTIFICATES":      "web",
+		"CA_CERT_WEB_DOMAINS":  "web.home.arpa,192.168.1.10",
+		"CA_CERT_WEB_PATH":     filepath.Join(dir, "web"),
+		"CA_CERT_WEB_DAYS":     "30",
+		"CA_CERT_WEB_KEY_TYPE": "EC256",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+	}
+	t.Cleanup(func() {
+		for key := range env {
+			os.Unsetenv(key)
+		}
+	})
+
+	config := getCaConfig()
+	if err := initCA(config); err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	ca, err := loadCA(config)
+	if err != nil {
+		t.Fatalf("Failed to load CA: %v", err)
+	}
+	certs, err := getCACertificates(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return ca, certs
+}
+
+func TestCAIssue(t *testing.T) {
+	ca, certs := testCA(t)
+
+	if err := initCA(ca.config); err == nil {
+		t.Error("Expected an error when the CA already exists")
+	}
+
+	results := renewCACertificates(ca, certs, false)
+	if results[0].Status != "issued" {
+		t.Fatalf("Expected the certificate to be issued, got %s: %s", results[0].Status, results[0].Detail)
+	}
+
+	leaf, err := readInstalledCertificate(filepath.Join(certs[0].Path, certs[0].certFile()))
+	if err != nil {
+		t.Fatalf("Failed to read certificate: %v", err)
+	}
+	root, err := readInstalledCertificate(filepath.Join(ca.config.Dir, caRootCert))
+	if err != nil {
+		t.Fatalf("Failed to read root: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(ca.cert)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "web.home.arpa", Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("Certificate does not verify: %v", err)
+	}
+	if err := leaf.VerifyHostname("192.168.1.10"); err != nil {
+		t.Errorf("Expected the IP address in the certificate: %v", err)
+	}
+	if len(leaf.ExtKeyUsage) != 1 || leaf.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("Expected server auth usage, got %v", leaf.ExtKeyUsage)
+	}
+	if len(leaf.CRLDistributionPoints) != 1 || leaf.CRLDistributionPoints[0] != "http://ca.example.com/crl.der" {
+		t.Errorf("Unexpected CRL distribution points %v", leaf.CRLDistributionPoints)
+	}
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime > 31*24*time.Hour {
+		t.Errorf("Expected a 30 day certificate, got %v", lifetime)
+	}
+
+	index, err := loadCAIndex(ca.config.Dir)
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	if len(index.Certificates) != 1 || index.Certificates[0].Serial != fmt.Sprintf("%x", leaf.SerialNumber) {
+		t.Errorf("Expected the certificate in the index, got %+v", index.Certificates)
+	}
+
+	// The IP address must not be taken for a changed domain list
+	results = renewCACertificates(ca, certs, false)
+	if results[0].Status != "skipped" {
+		t.Errorf("Expected the renewal to be skipped, got %s: %s", results[0].Status, results[0].Detail)
+	}
+}
+
+func TestCARevoke(t *testing.T) {
+	ca, certs := testCA(t)
+
+	renewCACertificates(ca, certs, true)
+	renewCACertificates(ca, certs, true)
+
+	serials, err := ca.revoke("web", 1, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(serials) != 2 {
+		t.Errorf("Expected both certificates to be revoked, got %v", serials)
+	}
+	if _, err := ca.revoke(serials[0], 1, time.Now()); err == nil {
+		t.Error("Expected an error when revoking twice")
+	}
+	if _, err := ca.revoke("unknown", 1, time.Now()); err == nil {
+		t.Error("Expected an error for an unknown certificate")
+	}
+
+	der, err := os.ReadFile(filepath.Join(ca.config.Dir, caCRLDERFile))
+	if err != nil {
+		t.Fatalf("Failed to read CRL: %v", err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CRL: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(ca.cert); err != nil {
+		t.Errorf("CRL is not signed by the intermediate: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 2 {
+		t.Fatalf("Expected 2 revoked certificates, got %d", len(crl.RevokedCertificateEntries))
+	}
+	if entry := crl.RevokedCertificateEntries[0]; entry.ReasonCode != 1 {
+		t.Errorf("Expected reason keyCompromise, got %d", entry.ReasonCode)
+	}
+	if crl.Number.Int64() != 1 {
+		t.Errorf("Expected CRL number 1, got %v", crl.Number)
+	}
+
+	due, err := ca.crlDue(time.Now())
+	if err != nil || due {
+		t.Errorf("Expected the fresh CRL not to be due, got %v, %v", due, err)
+	}
+	if due, _ := ca.crlDue(time.Now().AddDate(0, 0, 4)); !due {
+		t.Error("Expected the CRL to be due after half its lifetime")
+	}
+}
+
+func TestCACertificatesConfig(t *testing.T) {
+	os.Setenv("CA_CERTIFICATES", "vpn")
+	os.Setenv("CA_CERT_VPN_DOMAINS", "alice@example.com")
+	os.Setenv("CA_CERT_VPN_PATH", t.TempDir())
+	os.Setenv("CA_CERT_VPN_TYPE", "peer")
+	defer func() {
+		for _, key := range []string{"CA_CERTIFICATES", "CA_CERT_VPN_DOMAINS", "CA_CERT_VPN_PATH", "CA_CERT_VPN_TYPE"} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	if _, err := getCACertificates(getCaConfig()); err == nil {
+		t.Error("Expected an error for an unknown certificate type")
+	}
+
+	os.Setenv("CA_CERT_VPN_TYPE", "client")
+	certs, err := getCACertificates(getCaConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if certs[0].Type != caTypeClient || certs[0].Days != 90 {
+		t.Errorf("Unexpected certificate %+v", certs[0])
+	}
+}
+
+func TestCAIntermediateRotation(t *testing.T) {
+	ca, certs := testCA(t)
+	renewCACertificates(ca, certs, false)
+	old := ca.serial()
+
+	if err := renewIntermediate(ca.config); err != nil {
+		t.Fatalf("Failed to replace intermediate: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(ca.config.Dir, caRetiredDir, old+".crt")); err != nil {
+		t.Errorf("Expected the previous intermediate to be kept: %v", err)
+	}
+	rotated, err := loadCA(ca.config)
+	if err != nil {
+		t.Fatalf("Failed to load CA: %v", err)
+	}
+
+	results := renewCACertificates(rotated, certs, false)
+	if results[0].Status != "issued" {
+		t.Fatalf("Expected the certificate of the retired intermediate to be reissued, got %s: %s", results[0].Status, results[0].Detail)
+	}
+	if results = renewCACertificates(rotated, certs, false); results[0].Status != "skipped" {
+		t.Errorf("Expected the reissued certificate to be kept, got %s: %s", results[0].Status, results[0].Detail)
+	}
+
+	index, _ := loadCAIndex(ca.config.Dir)
+	if len(index.Certificates) != 2 || index.Certificates[0].Issuer != old || index.Certificates[1].Issuer != rotated.serial() {
+		t.Errorf("Expected the issuer of every certificate in the index, got %+v", index.Certificates)
+	}
+}
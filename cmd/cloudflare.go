@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// cloudflareAPI is the base URL of the Cloudflare API, replaced in tests
+var cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareClient manages DNS records through the Cloudflare API, the DDNS
+// records as well as the TLSA and CAA records of certificates
+type cloudflareClient struct {
+	token      string
+	httpClient *http.Client
+	zones      map[string]string
+}
+
+// cloudflareRecord is a DNS record. Data holds the fields of structured
+// records such as TLSA and CAA.
+type cloudflareRecord struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Name    string          `json:"name"`
+	Content string          `json:"content,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	TTL     int             `json:"ttl,omitempty"`
+	Proxied *bool           `json:"proxied,omitempty"`
+}
+
+// newCloudflareClient returns a client using the DNS-01 token of the Cloudflare provider
+func newCloudflareClient() (*cloudflareClient, error) {
+	token := getEnv("CLOUDFLARE_DNS_API_TOKEN", getEnv("CF_API_TOKEN", ""))
+	if file := os.Getenv("CLOUDFLARE_DNS_API_TOKEN_FILE"); token == "" && file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Cloudflare token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token == "" {
+		return nil, fmt.Errorf("CLOUDFLARE_DNS_API_TOKEN or CF_API_TOKEN is required")
+	}
+	return newCloudflareTokenClient(token), nil
+}
+
+// newCloudflareTokenClient returns a client using token
+func newCloudflareTokenClient(token string) *cloudflareClient {
+	return &cloudflareClient{
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		zones:      map[string]string{},
+	}
+}
+
+// do sends a request to the API and decodes the result of the response into result
+func (c *cloudflareClient) do(method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, cloudflareAPI+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if !response.Success {
+		var messages []string
+		for _, e := range response.Errors {
+			messages = append(messages, fmt.Sprintf("%s (%d)", e.Message, e.Code))
+		}
+		return fmt.Errorf("%s %s: %s", method, path, strings.Join(messages, ", "))
+	}
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
+
+// zoneID returns the ID of the zone name belongs to, walking up the labels of name
+func (c *cloudflareClient) zoneID(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for candidate := name; strings.Contains(candidate, "."); {
+		if id, ok := c.zones[candidate]; ok {
+			return id, nil
+		}
+
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := c.do(http.MethodGet, "/zones?name="+url.QueryEscape(candidate), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			c.zones[candidate] = zones[0].ID
+			return zones[0].ID, nil
+		}
+
+		_, candidate, _ = strings.Cut(candidate, ".")
+	}
+	return "", fmt.Errorf("no Cloudflare zone found for %s", name)
+}
+
+// records returns the records of recordType at name
+func (c *cloudflareClient) records(zoneID, recordType, name string) ([]cloudflareRecord, error) {
+	var records []cloudflareRecord
+	query := url.Values{"type": {recordType}, "name": {name}, "per_page": {"100"}}
+	err := c.do(http.MethodGet, fmt.Sprintf("/zones/%s/dns_records?%s", zoneID, query.Encode()), nil, &records)
+	return records, err
+}
+
+// createRecord adds a record to the zone
+func (c *cloudflareClient) createRecord(zoneID string, record cloudflareRecord) error {
+	return c.do(http.MethodPost, fmt.Sprintf("/zones/%s/dns_records", zoneID), record, nil)
+}
+
+// updateRecord replaces the record with the ID of record
+func (c *cloudflareClient) updateRecord(zoneID string, record cloudflareRecord) error {
+	return c.do(http.MethodPut, fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, record.ID), record, nil)
+}
+
+// deleteRecord removes a record from the zone
+func (c *cloudflareClient) deleteRecord(zoneID, id string) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, id), nil, nil)
+}
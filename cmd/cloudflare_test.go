@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCloudflare is an in-memory Cloudflare API serving the zone example.com
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	records []cloudflareRecord
+	nextID  int
+}
+
+// newFakeCloudflare starts a fake API and points the client at it
+func newFakeCloudflare(t *testing.T) *fakeCloudflare {
+	t.Helper()
+
+	fake := &fakeCloudflare{}
+	server := httptest.NewServer(http.HandlerFunc(fake.serve))
+	api, token := cloudflareAPI, os.Getenv("CLOUDFLARE_DNS_API_TOKEN")
+	cloudflareAPI = server.URL
+	os.Setenv("CLOUDFLARE_DNS_API_TOKEN", "test_token")
+	t.Cleanup(func() {
+		server.Close()
+		cloudflareAPI = api
+		os.Setenv("CLOUDFLARE_DNS_API_TOKEN", token)
+	})
+	return fake
+}
+
+func (f *fakeCloudflare) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reply := func(result interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "errors": []interface{}{}, "result": result})
+	}
+
+	if r.Header.Get("Authorization") != "Bearer test_token" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []map[string]interface{}{{"code": 9109, "message": "Invalid access token"}}})
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/zones":
+		zones := []map[string]string{}
+		if r.URL.Query().Get("name") == "example.com" {
+			zones = append(zones, map[string]string{"id": "zone"})
+		}
+		reply(zones)
+	case r.Method == http.MethodGet && r.URL.Path == "/zones/zone/dns_records":
+		records := []cloudflareRecord{}
+		for _, record := range f.records {
+			if record.Type == r.URL.Query().Get("type") && record.Name == r.URL.Query().Get("name") {
+				records = append(records, record)
+			}
+		}
+		reply(records)
+	case r.Method == http.MethodPost && r.URL.Path == "/zones/zone/dns_records":
+		var record cloudflareRecord
+		json.NewDecoder(r.Body).Decode(&record)
+		f.nextID++
+		record.ID = fmt.Sprintf("record%d", f.nextID)
+		f.records = append(f.records, record)
+		reply(record)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/zones/zone/dns_records/"):
+		var record cloudflareRecord
+		json.NewDecoder(r.Body).Decode(&record)
+		record.ID = strings.TrimPrefix(r.URL.Path, "/zones/zone/dns_records/")
+		for i := range f.records {
+			if f.records[i].ID == record.ID {
+				f.records[i] = record
+			}
+		}
+		reply(record)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/zones/zone/dns_records/"):
+		id := strings.TrimPrefix(r.URL.Path, "/zones/zone/dns_records/")
+		var kept []cloudflareRecord
+		for _, record := range f.records {
+			if record.ID != id {
+				kept = append(kept, record)
+			}
+		}
+		f.records = kept
+		reply(map[string]string{"id": id})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []map[string]interface{}{{"code": 7003, "message": "Not found"}}})
+	}
+}
+
+func TestCloudflareZoneID(t *testing.T) {
+	newFakeCloudflare(t)
+
+	client, err := newCloudflareClient()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	id, err := client.zoneID("_25._tcp.mail.Example.com.")
+	if err != nil || id != "zone" {
+		t.Errorf("Expected zone, got %q (%v)", id, err)
+	}
+	if _, err := client.zoneID("example.org"); err == nil {
+		t.Error("Expected error for unknown zone")
+	}
+
+	client.token = "wrong"
+	client.zones = map[string]string{}
+	if _, err := client.zoneID("example.com"); err == nil || !strings.Contains(err.Error(), "Invalid access token") {
+		t.Errorf("Expected API error, got %v", err)
+	}
+}
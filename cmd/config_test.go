@@ -79,3 +79,69 @@ func TestGetAcmeConfigDefaults(t *testing.T) {
 		t.Errorf("Expected default cert path './cert', got '%s'", config.CertPath)
 	}
 }
+
+func TestGetAcmeConfigDomains(t *testing.T) {
+	os.Setenv("ACME_DOMAINS", "*.nas.example.com, nas.example.com,photos.example.com")
+	defer os.Unsetenv("ACME_DOMAINS")
+
+	config := getAcmeConfig()
+
+	if len(config.Domains) != 3 || config.Domains[2] != "photos.example.com" {
+		t.Errorf("Expected 3 domains, got %v", config.Domains)
+	}
+	if config.Domain != "*.nas.example.com" {
+		t.Errorf("Expected primary domain '*.nas.example.com', got '%s'", config.Domain)
+	}
+	if config.CertName != "_.nas.example.com" {
+		t.Errorf("Expected certificate name '_.nas.example.com', got '%s'", config.CertName)
+	}
+
+	os.Setenv("ACME_CERT_NAME", "nas")
+	defer os.Unsetenv("ACME_CERT_NAME")
+
+	if config := getAcmeConfig(); config.CertName != "nas" {
+		t.Errorf("Expected certificate name 'nas', got '%s'", config.CertName)
+	}
+}
+
+func TestGetAcmeConfigDirectory(t *testing.T) {
+	if config := getAcmeConfig(); config.CADirURL != "https://acme-v02.api.letsencrypt.org/directory" {
+		t.Errorf("Expected Let's Encrypt production by default, got '%s'", config.CADirURL)
+	}
+
+	os.Setenv("ACME_DIRECTORY", "letsencrypt-staging")
+	if config := getAcmeConfig(); config.CADirURL != "https://acme-staging-v02.api.letsencrypt.org/directory" {
+		t.Errorf("Expected Let's Encrypt staging, got '%s'", config.CADirURL)
+	}
+
+	os.Setenv("ACME_DIRECTORY", "https://localhost:14000/dir")
+	if config := getAcmeConfig(); config.CADirURL != "https://localhost:14000/dir" {
+		t.Errorf("Expected custom directory, got '%s'", config.CADirURL)
+	}
+
+	os.Unsetenv("ACME_DIRECTORY")
+}
+
+func TestValidateAcmeConfig(t *testing.T) {
+	config := AcmeConfig{CADirURL: "https://localhost:14000/dir"}
+	if err := validateAcmeConfig(config); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	config.CADirURL = "pebble"
+	if err := validateAcmeConfig(config); err == nil {
+		t.Error("Expected error for unknown directory preset")
+	}
+
+	config.CADirURL = "https://acme.zerossl.com/v2/DV90"
+	config.EABKeyID = "kid"
+	if err := validateAcmeConfig(config); err == nil {
+		t.Error("Expected error for EAB key ID without HMAC")
+	}
+
+	config.EABHMAC = "aG1hYw"
+	config.CABundle = "/non/existent/bundle.pem"
+	if err := validateAcmeConfig(config); err == nil {
+		t.Error("Expected error for missing CA bundle")
+	}
+}
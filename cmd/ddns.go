@@ -1,8 +1,7 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -25,143 +24,178 @@ var updateCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		config := getDDNSConfig()
 
-		if config.APIToken == "" || config.ZoneID == "" || config.RecordName == "" {
-			fmt.Println("Error: CF_API_TOKEN, CF_ZONE_ID, and CF_RECORD_NAME environment variables are required")
+		if config.APIToken == "" || config.ZoneID == "" || (config.RecordName == "" && len(getEnvList("DDNS_UPLINKS")) == 0) {
+			fmt.Println("Error: CF_API_TOKEN, CF_ZONE_ID, and CF_RECORD_NAME (or DDNS_UPLINKS) environment variables are required")
 			os.Exit(1)
 		}
-
-		currentIP := getCurrentIP("https://api.ipify.org")
-		currentIPv6 := getCurrentIP("https://api6.ipify.org")
-
-		if currentIP == "" && currentIPv6 == "" {
-			logError("could not get current public IPs", config.LogFile)
+		if err := validateHookPolicy("DDNS_HOOK_FAILURE_POLICY", config.HookPolicy); err != nil {
+			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
 
-		cachedIP4, cachedIP6 := readCache(config.CacheFile)
-
-		// Update IPv4
-		if currentIP != "" && currentIP != cachedIP4 {
-			if updateRecord(config, "A", currentIP) {
-				cachedIP4 = currentIP
-				logInfo(fmt.Sprintf("Updated A %s → %s", config.RecordName, currentIP), config.LogFile)
+		failed := false
+		for _, uplink := range getUplinks(config) {
+			if err := syncUplink(config, uplink); err != nil {
+				logError(err.Error(), config.LogFile)
+				failed = true
 			}
-		} else {
-			logInfo(fmt.Sprintf("IPv4 unchanged (%s)", currentIP), config.LogFile)
 		}
 
-		// Update IPv6
-		if currentIPv6 != "" && currentIPv6 != cachedIP6 {
-			if updateRecord(config, "AAAA", currentIPv6) {
-				cachedIP6 = currentIPv6
-				logInfo(fmt.Sprintf("Updated AAAA %s → %s", config.RecordName, currentIPv6), config.LogFile)
-			}
-		} else {
-			logInfo(fmt.Sprintf("IPv6 unchanged (%s)", currentIPv6), config.LogFile)
+		if failed {
+			os.Exit(1)
 		}
-
-		writeCache(config.CacheFile, cachedIP4, cachedIP6)
 	},
 }
 
 type DDNSConfig struct {
-	APIToken   string
-	ZoneID     string
-	RecordName string
-	LogFile    string
-	CacheFile  string
+	APIToken    string
+	ZoneID      string
+	RecordName  string
+	LogFile     string
+	CacheFile   string
+	IPv4URL     string
+	IPv6URL     string
+	PreHook     string
+	PostHook    string
+	HookTimeout time.Duration
+	HookPolicy  string
 }
 
 func getDDNSConfig() DDNSConfig {
 	return DDNSConfig{
-		APIToken:   getEnv("CF_API_TOKEN", ""),
-		ZoneID:     getEnv("CF_ZONE_ID", ""),
-		RecordName: getEnv("CF_RECORD_NAME", ""),
-		LogFile:    getEnv("DDNS_LOG_FILE", "./ddns.log"),
-		CacheFile:  getEnv("DDNS_CACHE_FILE", "./.ddns.cache"),
+		APIToken:    getEnv("CF_API_TOKEN", ""),
+		ZoneID:      getEnv("CF_ZONE_ID", ""),
+		RecordName:  getEnv("CF_RECORD_NAME", ""),
+		LogFile:     getEnv("DDNS_LOG_FILE", "./ddns.log"),
+		CacheFile:   getEnv("DDNS_CACHE_FILE", "./.ddns.cache"),
+		IPv4URL:     getEnv("DDNS_IPV4_URL", "https://api.ipify.org"),
+		IPv6URL:     getEnv("DDNS_IPV6_URL", "https://api6.ipify.org"),
+		PreHook:     getEnv("DDNS_PRE_HOOK", ""),
+		PostHook:    getEnv("DDNS_POST_HOOK", ""),
+		HookTimeout: getEnvDuration("DDNS_HOOK_TIMEOUT", 30*time.Second),
+		HookPolicy:  strings.ToLower(getEnv("DDNS_HOOK_FAILURE_POLICY", hookPolicyIgnore)),
 	}
 }
 
-func getCurrentIP(url string) string {
-	resp, err := http.Get(url)
-	if err != nil {
-		return ""
+// syncRecord publishes currentIP for recordType to all records of the uplink
+// when it differs from cachedIP and runs the configured hooks around each update.
+// It returns the IP to cache, which only changes when every record was updated
+// and, with the failure policy "fail", its hooks succeeded, so the next run retries
+// them. An error is only returned when a hook failed and the policy is "fail".
+func syncRecord(config DDNSConfig, uplink Uplink, recordType, currentIP, cachedIP string) (string, error) {
+	family, label := "ipv4", "IPv4"
+	if recordType == "AAAA" {
+		family, label = "ipv6", "IPv6"
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return ""
+	if currentIP == "" || currentIP == cachedIP {
+		logInfo(uplink.label(fmt.Sprintf("%s unchanged (%s)", label, currentIP)), config.LogFile)
+		return cachedIP, nil
 	}
 
-	return strings.TrimSpace(string(body))
-}
+	updated := true
+	var errs []string
+	for _, recordName := range uplink.Records {
+		env := map[string]string{
+			"DDNS_UPLINK":      uplink.Name,
+			"DDNS_RECORD":      recordName,
+			"DDNS_RECORD_TYPE": recordType,
+			"DDNS_FAMILY":      family,
+			"DDNS_OLD_IP":      cachedIP,
+			"DDNS_NEW_IP":      currentIP,
+		}
 
-func updateRecord(config DDNSConfig, recordType, ip string) bool {
-	recordID := getRecordID(config, recordType)
-	if recordID == "" {
-		logError(fmt.Sprintf("%s record %s not found", recordType, config.RecordName), config.LogFile)
-		return false
-	}
+		if err := runDDNSHooks(config, config.PreHook, "pre", env); err != nil {
+			if config.HookPolicy == hookPolicyFail {
+				errs = append(errs, fmt.Sprintf("skipping %s update for %s: %v", recordType, recordName, err))
+				updated = false
+				continue
+			}
+			logError(err.Error(), config.LogFile)
+		}
 
-	data := map[string]interface{}{
-		"type":    recordType,
-		"name":    config.RecordName,
-		"content": ip,
-		"proxied": true,
-	}
+		if !updateRecord(config, recordName, recordType, currentIP) {
+			updated = false
+			continue
+		}
+		logInfo(uplink.label(fmt.Sprintf("Updated %s %s → %s", recordType, recordName, currentIP)), config.LogFile)
 
-	jsonData, _ := json.Marshal(data)
+		if err := runDDNSHooks(config, config.PostHook, "post", env); err != nil {
+			if config.HookPolicy == hookPolicyFail {
+				errs = append(errs, err.Error())
+				updated = false
+				continue
+			}
+			logError(err.Error(), config.LogFile)
+		}
+	}
 
-	req, _ := http.NewRequest("PUT", fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records/%s", config.ZoneID, recordID), bytes.NewBuffer(jsonData))
-	req.Header.Set("Authorization", "Bearer "+config.APIToken)
-	req.Header.Set("Content-Type", "application/json")
+	if !updated {
+		currentIP = cachedIP
+	}
+	if len(errs) > 0 {
+		return currentIP, errors.New(strings.Join(errs, "; "))
+	}
+	return currentIP, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// runDDNSHooks runs the hooks configured in value with the record environment
+func runDDNSHooks(config DDNSConfig, value, phase string, env map[string]string) error {
+	hooks, err := parseHooks(value)
 	if err != nil {
-		logError(fmt.Sprintf("%s update failed: %v", recordType, err), config.LogFile)
-		return false
+		return fmt.Errorf("%s hook: %v", phase, err)
+	}
+	if len(hooks) == 0 {
+		return nil
 	}
-	defer resp.Body.Close()
-
-	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
 
-	if success, ok := result["success"].(bool); ok && success {
-		return true
+	phaseEnv := map[string]string{"DDNS_HOOK_PHASE": phase}
+	for key, value := range env {
+		phaseEnv[key] = value
 	}
 
-	logError(fmt.Sprintf("%s update failed", recordType), config.LogFile)
-	return false
+	return runHooks(hooks, phaseEnv, config.HookTimeout, func(msg string) {
+		logInfo(msg, config.LogFile)
+	})
 }
 
-func getRecordID(config DDNSConfig, recordType string) string {
-	url := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records?name=%s&type=%s", config.ZoneID, config.RecordName, recordType)
-
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", "Bearer "+config.APIToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func getCurrentIP(url string) string {
+	resp, err := http.Get(url)
 	if err != nil {
 		return ""
 	}
 	defer resp.Body.Close()
 
-	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
 
-	if resultArray, ok := result["result"].([]interface{}); ok && len(resultArray) > 0 {
-		if record, ok := resultArray[0].(map[string]interface{}); ok {
-			if id, ok := record["id"].(string); ok {
-				return id
-			}
-		}
+	return strings.TrimSpace(string(body))
+}
+
+// updateRecord points the existing record of recordType at ip
+func updateRecord(config DDNSConfig, recordName, recordType, ip string) bool {
+	client := newCloudflareTokenClient(config.APIToken)
+	records, err := client.records(config.ZoneID, recordType, recordName)
+	if err != nil {
+		logError(fmt.Sprintf("%s lookup failed: %v", recordType, err), config.LogFile)
+		return false
+	}
+	if len(records) == 0 {
+		logError(fmt.Sprintf("%s record %s not found", recordType, recordName), config.LogFile)
+		return false
 	}
 
-	return ""
+	proxied := true
+	record := records[0]
+	record.Content = ip
+	record.Proxied = &proxied
+	if err := client.updateRecord(config.ZoneID, record); err != nil {
+		logError(fmt.Sprintf("%s update failed: %v", recordType, err), config.LogFile)
+		return false
+	}
+	return true
 }
 
 func readCache(cacheFile string) (string, string) {
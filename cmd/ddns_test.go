@@ -4,7 +4,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetCurrentIP(t *testing.T) {
@@ -29,6 +32,66 @@ func TestGetCurrentIPError(t *testing.T) {
 	}
 }
 
+func TestUpdateRecord(t *testing.T) {
+	fake := newFakeCloudflare(t)
+	fake.records = []cloudflareRecord{{ID: "a", Type: "A", Name: "nas.example.com", Content: "192.0.2.1", TTL: 300}}
+	config := DDNSConfig{APIToken: "test_token", ZoneID: "zone", LogFile: filepath.Join(t.TempDir(), "ddns.log")}
+
+	if !updateRecord(config, "nas.example.com", "A", "192.0.2.2") {
+		t.Fatal("Expected the record to be updated")
+	}
+	record := fake.records[0]
+	if record.ID != "a" || record.Content != "192.0.2.2" || record.TTL != 300 || record.Proxied == nil || !*record.Proxied {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+
+	if updateRecord(config, "nas.example.com", "AAAA", "2001:db8::1") {
+		t.Error("Expected a missing record not to be updated")
+	}
+	config.APIToken = "wrong"
+	if updateRecord(config, "nas.example.com", "A", "192.0.2.3") {
+		t.Error("Expected an API error not to update the record")
+	}
+}
+
+func TestSyncRecordRetriesFailedHook(t *testing.T) {
+	fake := newFakeCloudflare(t)
+	fake.records = []cloudflareRecord{{ID: "a", Type: "A", Name: "nas.example.com", Content: "192.0.2.1"}}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "hook.out")
+	hook := filepath.Join(dir, "hook.sh")
+	os.WriteFile(hook, []byte("#!/bin/sh\necho \"$DDNS_NEW_IP\" >> "+out+"\nexit 1\n"), 0755)
+	config := DDNSConfig{
+		APIToken:    "test_token",
+		ZoneID:      "zone",
+		LogFile:     filepath.Join(t.TempDir(), "ddns.log"),
+		PostHook:    hook,
+		HookTimeout: 10 * time.Second,
+		HookPolicy:  hookPolicyFail,
+	}
+	uplink := Uplink{Name: defaultUplink, Records: []string{"nas.example.com"}}
+
+	cached := "192.0.2.1"
+	for i := 0; i < 2; i++ {
+		var err error
+		cached, err = syncRecord(config, uplink, "A", "192.0.2.2", cached)
+		if err == nil {
+			t.Error("Expected the failing hook to be reported")
+		}
+		if cached != "192.0.2.1" {
+			t.Errorf("Expected the old IP to stay cached, got %s", cached)
+		}
+	}
+
+	data, _ := os.ReadFile(out)
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("Expected the hook to run on both syncs, ran %d times", lines)
+	}
+	if fake.records[0].Content != "192.0.2.2" {
+		t.Errorf("Expected the record to be updated, got %s", fake.records[0].Content)
+	}
+}
+
 func TestReadWriteCache(t *testing.T) {
 	cacheFile := "/tmp/test_ddns_cache"
 
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	hookPolicyIgnore = "ignore"
+	hookPolicyFail   = "fail"
+)
+
+// Hook is an external command run at a defined point of a workflow
+type Hook struct {
+	Command string
+	Args    []string
+}
+
+func (h Hook) String() string {
+	return strings.Join(append([]string{h.Command}, h.Args...), " ")
+}
+
+// HookResult holds the outcome of a single hook execution
+type HookResult struct {
+	Hook     Hook
+	Output   string
+	Err      error
+	Duration time.Duration
+}
+
+// validateHookPolicy checks that policy is a known hook failure policy
+func validateHookPolicy(key, policy string) error {
+	if policy != hookPolicyIgnore && policy != hookPolicyFail {
+		return fmt.Errorf("%s: unknown hook failure policy %q (use ignore or fail)", key, policy)
+	}
+	return nil
+}
+
+// parseHooks parses a list of commands separated by semicolons.
+// Arguments are split on whitespace, quotes group arguments containing spaces.
+func parseHooks(value string) ([]Hook, error) {
+	var hooks []Hook
+	for _, line := range strings.Split(value, ";") {
+		args, err := splitCommandLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hook %q: %v", strings.TrimSpace(line), err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		hooks = append(hooks, Hook{Command: args[0], Args: args[1:]})
+	}
+	return hooks, nil
+}
+
+// splitCommandLine splits a command line into arguments honoring single and double quotes
+func splitCommandLine(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// runHook executes a hook with the given extra environment and timeout
+func runHook(hook Hook, env map[string]string, timeout time.Duration) HookResult {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, hook.Command, hook.Args...)
+	command.Env = append(os.Environ(), hookEnv(env)...)
+	command.WaitDelay = time.Second
+
+	start := time.Now()
+	output, err := command.CombinedOutput()
+	result := HookResult{
+		Hook:     hook,
+		Output:   strings.TrimSpace(string(output)),
+		Duration: time.Since(start),
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		result.Err = fmt.Errorf("timed out after %s", timeout)
+	} else if err != nil {
+		result.Err = err
+	}
+	return result
+}
+
+// runHooks executes hooks in order and stops at the first failure
+func runHooks(hooks []Hook, env map[string]string, timeout time.Duration, logf func(string)) error {
+	for _, hook := range hooks {
+		result := runHook(hook, env, timeout)
+		for _, line := range strings.Split(result.Output, "\n") {
+			if line != "" {
+				logf(fmt.Sprintf("hook %s: %s", hook.Command, line))
+			}
+		}
+		if result.Err != nil {
+			return fmt.Errorf("hook %q failed: %v", hook.String(), result.Err)
+		}
+		logf(fmt.Sprintf("hook %s finished in %s", hook.Command, result.Duration.Round(time.Millisecond)))
+	}
+	return nil
+}
+
+func hookEnv(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	vars := make([]string, 0, len(keys))
+	for _, key := range keys {
+		vars = append(vars, key+"="+env[key])
+	}
+	return vars
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	args, err := splitCommandLine(`/usr/bin/wg set wg0 peer "abc def" endpoint 'x y'`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{"/usr/bin/wg", "set", "wg0", "peer", "abc def", "endpoint", "x y"}
+	if strings.Join(args, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected %v, got %v", expected, args)
+	}
+
+	if _, err := splitCommandLine(`echo "unterminated`); err == nil {
+		t.Error("Expected error for unterminated quote")
+	}
+}
+
+func TestParseHooks(t *testing.T) {
+	hooks, err := parseHooks("/opt/hooks/firewall.sh --allow; ; /opt/hooks/wg.sh")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(hooks) != 2 {
+		t.Fatalf("Expected 2 hooks, got %d", len(hooks))
+	}
+	if hooks[0].Command != "/opt/hooks/firewall.sh" || len(hooks[0].Args) != 1 || hooks[0].Args[0] != "--allow" {
+		t.Errorf("Unexpected first hook: %+v", hooks[0])
+	}
+	if hooks[1].Command != "/opt/hooks/wg.sh" || len(hooks[1].Args) != 0 {
+		t.Errorf("Unexpected second hook: %+v", hooks[1])
+	}
+
+	hooks, err = parseHooks("")
+	if err != nil || len(hooks) != 0 {
+		t.Errorf("Expected no hooks for empty value, got %v, %v", hooks, err)
+	}
+}
+
+func TestValidateHookPolicy(t *testing.T) {
+	for _, policy := range []string{hookPolicyIgnore, hookPolicyFail} {
+		if err := validateHookPolicy("DDNS_HOOK_FAILURE_POLICY", policy); err != nil {
+			t.Errorf("Unexpected error for %s: %v", policy, err)
+		}
+	}
+	if err := validateHookPolicy("DDNS_HOOK_FAILURE_POLICY", "fial"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestRunHookEnvironment(t *testing.T) {
+	hook := Hook{Command: "sh", Args: []string{"-c", "echo $DDNS_OLD_IP $DDNS_NEW_IP"}}
+	result := runHook(hook, map[string]string{"DDNS_OLD_IP": "192.0.2.1", "DDNS_NEW_IP": "192.0.2.2"}, 5*time.Second)
+
+	if result.Err != nil {
+		t.Fatalf("Unexpected error: %v", result.Err)
+	}
+	if result.Output != "192.0.2.1 192.0.2.2" {
+		t.Errorf("Expected '192.0.2.1 192.0.2.2', got '%s'", result.Output)
+	}
+}
+
+func TestRunHookTimeout(t *testing.T) {
+	hook := Hook{Command: "sleep", Args: []string{"5"}}
+	result := runHook(hook, nil, 100*time.Millisecond)
+
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "timed out") {
+		t.Errorf("Expected timeout error, got %v", result.Err)
+	}
+}
+
+func TestRunHooksStopsOnFailure(t *testing.T) {
+	hooks := []Hook{
+		{Command: "sh", Args: []string{"-c", "echo first"}},
+		{Command: "sh", Args: []string{"-c", "echo broken; exit 3"}},
+		{Command: "sh", Args: []string{"-c", "echo never"}},
+	}
+
+	var logged []string
+	err := runHooks(hooks, nil, 5*time.Second, func(msg string) {
+		logged = append(logged, msg)
+	})
+
+	if err == nil {
+		t.Fatal("Expected error from failing hook")
+	}
+
+	output := strings.Join(logged, "\n")
+	if !strings.Contains(output, "first") || !strings.Contains(output, "broken") {
+		t.Errorf("Expected hook output in log, got %q", output)
+	}
+	if strings.Contains(output, "never") {
+		t.Errorf("Expected hooks after failure to be skipped, got %q", output)
+	}
+}
@@ -30,7 +30,8 @@ A CLI tool for DDNS and certificate management.
 
 Features:
 - DDNS Management: Update Cloudflare DNS records with current public IP
-- ACME Certificates: Issue/renew Let's Encrypt certificates via Cloudflare DNS`,
+- ACME Certificates: Issue/renew Let's Encrypt certificates via Cloudflare DNS
+- Private CA: Issue/renew internal server and client certificates`,
 	Version: Version,
 }
 
@@ -52,6 +53,7 @@ func Execute() {
 func init() {
 	loadConfig()
 	rootCmd.AddCommand(acmeCmd)
+	rootCmd.AddCommand(caCmd)
 	rootCmd.AddCommand(ddnsCmd)
 	rootCmd.AddCommand(versionCmd)
 }
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultUplink = "default"
+
+// errNoSourceAddress is returned when an uplink has no source address for an address family
+var errNoSourceAddress = errors.New("no source address")
+
+// Uplink is a WAN connection whose public IPs are published to a set of records
+type Uplink struct {
+	Name      string
+	Interface string
+	Sources   []string
+	Records   []string
+	IPv4URL   string
+	IPv6URL   string
+	CacheFile string
+}
+
+// getUplinks returns the configured uplinks. Without DDNS_UPLINKS a single
+// default uplink publishes CF_RECORD_NAME through the default route.
+func getUplinks(config DDNSConfig) []Uplink {
+	names := getEnvList("DDNS_UPLINKS")
+	if len(names) == 0 {
+		return []Uplink{{
+			Name:      defaultUplink,
+			Records:   []string{config.RecordName},
+			IPv4URL:   config.IPv4URL,
+			IPv6URL:   config.IPv6URL,
+			CacheFile: config.CacheFile,
+		}}
+	}
+
+	uplinks := make([]Uplink, 0, len(names))
+	for _, name := range names {
+		prefix := "DDNS_UPLINK_" + envName(name) + "_"
+		uplinks = append(uplinks, Uplink{
+			Name:      name,
+			Interface: getEnv(prefix+"INTERFACE", ""),
+			Sources:   getEnvList(prefix + "SOURCE"),
+			Records:   getEnvList(prefix + "RECORDS"),
+			IPv4URL:   getEnv(prefix+"IPV4_URL", config.IPv4URL),
+			IPv6URL:   getEnv(prefix+"IPV6_URL", config.IPv6URL),
+			CacheFile: config.CacheFile + "." + name,
+		})
+	}
+	return uplinks
+}
+
+// label prefixes log messages of named uplinks
+func (u Uplink) label(msg string) string {
+	if u.Name == defaultUplink {
+		return msg
+	}
+	return fmt.Sprintf("[%s] %s", u.Name, msg)
+}
+
+// bound reports whether the uplink is tied to an interface or source address
+func (u Uplink) bound() bool {
+	return u.Interface != "" || len(u.Sources) > 0
+}
+
+// localAddr returns the source address the uplink uses for family ("ipv4" or "ipv6")
+func (u Uplink) localAddr(family string) (net.IP, error) {
+	for _, source := range u.Sources {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address %q", source)
+		}
+		if (ip.To4() != nil) == (family == "ipv4") {
+			return ip, nil
+		}
+	}
+
+	if u.Interface != "" {
+		iface, err := net.InterfaceByName(u.Interface)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			if (ipNet.IP.To4() != nil) == (family == "ipv4") {
+				return ipNet.IP, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w for %s on uplink %s", errNoSourceAddress, family, u.Name)
+}
+
+// currentIP looks up the public IP of the uplink for family
+func (u Uplink) currentIP(family string) (string, error) {
+	url := u.IPv4URL
+	if family == "ipv6" {
+		url = u.IPv6URL
+	}
+
+	if !u.bound() {
+		return getCurrentIP(url), nil
+	}
+
+	localIP, err := u.localAddr(family)
+	if err != nil {
+		return "", err
+	}
+	return getCurrentIPFrom(url, family, localIP), nil
+}
+
+// getCurrentIPFrom queries url through a connection bound to localIP
+func getCurrentIPFrom(url, family string, localIP net.IP) string {
+	network := "tcp4"
+	if family == "ipv6" {
+		network = "tcp6"
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		LocalAddr: &net.TCPAddr{IP: localIP},
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(body))
+}
+
+// syncUplink publishes the current IPs of an uplink to all of its records
+func syncUplink(config DDNSConfig, uplink Uplink) error {
+	if len(uplink.Records) == 0 {
+		return fmt.Errorf("uplink %s has no records configured", uplink.Name)
+	}
+
+	currentIP, err := uplink.currentIP("ipv4")
+	reportSourceError(config, uplink, "ipv4", err)
+	currentIPv6, err := uplink.currentIP("ipv6")
+	reportSourceError(config, uplink, "ipv6", err)
+
+	if currentIP == "" && currentIPv6 == "" {
+		return errors.New(uplink.label("could not get current public IPs"))
+	}
+
+	cachedIP4, cachedIP6 := readCache(uplink.CacheFile)
+	var errs []string
+
+	// Update IPv4
+	cachedIP4, err = syncRecord(config, uplink, "A", currentIP, cachedIP4)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	// Update IPv6
+	cachedIP6, err = syncRecord(config, uplink, "AAAA", currentIPv6, cachedIP6)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	writeCache(uplink.CacheFile, cachedIP4, cachedIP6)
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// reportSourceError logs why the IP of an uplink could not be looked up. A missing
+// source address for a family is an expected setup, e.g. on IPv4-only uplinks, and
+// is only logged once until a source address for the family is found again.
+func reportSourceError(config DDNSConfig, uplink Uplink, family string, err error) {
+	marker := uplink.CacheFile + ".nosource." + family
+	if err == nil {
+		os.Remove(marker)
+		return
+	}
+	if !errors.Is(err, errNoSourceAddress) {
+		logInfo(uplink.label(err.Error()), config.LogFile)
+		return
+	}
+	if _, statErr := os.Stat(marker); statErr == nil {
+		return
+	}
+	logInfo(uplink.label(err.Error()), config.LogFile)
+	os.WriteFile(marker, nil, 0644)
+}
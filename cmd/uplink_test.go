@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetUplinksDefault(t *testing.T) {
+	config := DDNSConfig{RecordName: "nas.example.com", CacheFile: "/tmp/ddns.cache"}
+
+	uplinks := getUplinks(config)
+	if len(uplinks) != 1 {
+		t.Fatalf("Expected 1 uplink, got %d", len(uplinks))
+	}
+	if uplinks[0].Name != defaultUplink || uplinks[0].bound() {
+		t.Errorf("Expected unbound default uplink, got %+v", uplinks[0])
+	}
+	if len(uplinks[0].Records) != 1 || uplinks[0].Records[0] != "nas.example.com" {
+		t.Errorf("Expected default record, got %v", uplinks[0].Records)
+	}
+	if uplinks[0].CacheFile != "/tmp/ddns.cache" {
+		t.Errorf("Expected default cache file, got '%s'", uplinks[0].CacheFile)
+	}
+}
+
+func TestGetUplinksConfigured(t *testing.T) {
+	os.Setenv("DDNS_UPLINKS", "wan1, wan-2")
+	os.Setenv("DDNS_UPLINK_WAN1_INTERFACE", "eth0")
+	os.Setenv("DDNS_UPLINK_WAN1_RECORDS", "wan1.example.com,nas.example.com")
+	os.Setenv("DDNS_UPLINK_WAN_2_SOURCE", "192.0.2.10, 2001:db8::10")
+	os.Setenv("DDNS_UPLINK_WAN_2_RECORDS", "wan2.example.com")
+	defer func() {
+		os.Unsetenv("DDNS_UPLINKS")
+		os.Unsetenv("DDNS_UPLINK_WAN1_INTERFACE")
+		os.Unsetenv("DDNS_UPLINK_WAN1_RECORDS")
+		os.Unsetenv("DDNS_UPLINK_WAN_2_SOURCE")
+		os.Unsetenv("DDNS_UPLINK_WAN_2_RECORDS")
+	}()
+
+	uplinks := getUplinks(DDNSConfig{CacheFile: "/tmp/ddns.cache"})
+	if len(uplinks) != 2 {
+		t.Fatalf("Expected 2 uplinks, got %d", len(uplinks))
+	}
+
+	if uplinks[0].Interface != "eth0" || len(uplinks[0].Records) != 2 {
+		t.Errorf("Unexpected wan1 uplink: %+v", uplinks[0])
+	}
+	if uplinks[0].CacheFile != "/tmp/ddns.cache.wan1" {
+		t.Errorf("Expected per uplink cache file, got '%s'", uplinks[0].CacheFile)
+	}
+	if len(uplinks[1].Sources) != 2 || uplinks[1].Records[0] != "wan2.example.com" {
+		t.Errorf("Unexpected wan-2 uplink: %+v", uplinks[1])
+	}
+}
+
+func TestUplinkLocalAddr(t *testing.T) {
+	uplink := Uplink{Name: "wan2", Sources: []string{"192.0.2.10", "2001:db8::10"}}
+
+	ip, err := uplink.localAddr("ipv4")
+	if err != nil || !ip.Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("Expected 192.0.2.10, got %v (%v)", ip, err)
+	}
+
+	ip, err = uplink.localAddr("ipv6")
+	if err != nil || !ip.Equal(net.ParseIP("2001:db8::10")) {
+		t.Errorf("Expected 2001:db8::10, got %v (%v)", ip, err)
+	}
+
+	if _, err := (Uplink{Name: "wan1", Sources: []string{"192.0.2.10"}}).localAddr("ipv6"); err == nil {
+		t.Error("Expected error for missing IPv6 source")
+	}
+}
+
+func TestReportSourceErrorOnce(t *testing.T) {
+	dir := t.TempDir()
+	config := DDNSConfig{LogFile: filepath.Join(dir, "ddns.log")}
+	uplink := Uplink{Name: "wan1", Sources: []string{"192.0.2.10"}, CacheFile: filepath.Join(dir, "cache")}
+	_, missing := uplink.localAddr("ipv6")
+
+	logged := func() int {
+		data, _ := os.ReadFile(config.LogFile)
+		return strings.Count(string(data), "no source address")
+	}
+
+	reportSourceError(config, uplink, "ipv6", missing)
+	reportSourceError(config, uplink, "ipv6", missing)
+	if n := logged(); n != 1 {
+		t.Errorf("Expected the missing source to be logged once, got %d", n)
+	}
+
+	// Logged again after a source address was found in between
+	reportSourceError(config, uplink, "ipv6", nil)
+	reportSourceError(config, uplink, "ipv6", missing)
+	if n := logged(); n != 2 {
+		t.Errorf("Expected the missing source to be logged again, got %d", n)
+	}
+}
+
+func TestGetCurrentIPFrom(t *testing.T) {
+	var remote string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote, _, _ = net.SplitHostPort(r.RemoteAddr)
+		w.Write([]byte("198.51.100.7\n"))
+	}))
+	defer server.Close()
+
+	ip := getCurrentIPFrom(server.URL, "ipv4", net.ParseIP("127.0.0.1"))
+	if ip != "198.51.100.7" {
+		t.Errorf("Expected '198.51.100.7', got '%s'", ip)
+	}
+	if remote != "127.0.0.1" {
+		t.Errorf("Expected request from 127.0.0.1, got '%s'", remote)
+	}
+}